@@ -10,18 +10,34 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	report "github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
 )
 
 type CarbonPublisher struct {
 	URLs []string
 
-	once sync.Once
-	feed []chan *Summary
+	once    sync.Once
+	mu      sync.RWMutex
+	stopped bool
+	feed    []chan *Summary
+	busy    sync.WaitGroup
 }
 
+// Send writes the summary to every connection.
+// Summaries sent after Stop are dropped.
 func (carbon *CarbonPublisher) Send(s *Summary) {
 	carbon.once.Do(carbon.initialize)
 
+	carbon.mu.RLock()
+	defer carbon.mu.RUnlock()
+
+	if carbon.stopped {
+		report.HandleError(fmt.Errorf("metric: dropping summary '%s': %s", s.Name, report.ErrStopped))
+		return
+	}
+
 	for i := range carbon.feed {
 		carbon.feed[i] <- s
 	}
@@ -34,33 +50,51 @@ func (carbon *CarbonPublisher) initialize() {
 		feed := make(chan *Summary)
 		carbon.feed[i] = feed
 
+		carbon.busy.Add(1)
 		go func(url string) {
+			defer carbon.busy.Done()
+
 			wait := time.Second
 			next := wait
 
 			var conn net.Conn
+			dial := func() {
+				var err error
+				if conn, err = net.Dial("tcp", url); err != nil {
+					log.Printf("%s (retry in %v)\n", err, next)
+					if next < time.Minute {
+						next *= 2
+					}
+
+					return
+				}
+
+				log.Printf("connected to '%s'\n", url)
+				next = wait
+			}
+
 			for {
 				select {
 				case <-time.After(next):
-					if conn != nil {
-						break
+					if conn == nil {
+						dial()
 					}
-
-					var err error
-					conn, err = net.Dial("tcp", url)
-					if err != nil {
-						log.Printf("%s (retry in %v)\n", err, next)
-						if next < time.Minute {
-							next *= 2
+				case summary, ok := <-feed:
+					if !ok {
+						if conn != nil {
+							conn.Close()
 						}
 
-						break
+						return
 					}
 
-					log.Printf("connected to '%s'\n", url)
-					next = wait
-				case summary := <-feed:
+					// the connection may not be up yet e.g. for the final summary
 					if conn == nil {
+						dial()
+					}
+
+					if conn == nil {
+						report.HandleError(fmt.Errorf("metric: dropping summary '%s' for '%s'", summary.Name, url))
 						break
 					}
 
@@ -68,10 +102,16 @@ func (carbon *CarbonPublisher) initialize() {
 					dt := float64(summary.Step) / float64(time.Second)
 
 					writer := bufio.NewWriter(conn)
+					// the series only exists for monitors that drop records
+					if summary.Dropped != 0 {
+						fmt.Fprintf(writer, "%s.Dropped %f %d\n", summary.Name, float64(summary.Dropped)/dt, when)
+					}
+
 					for name, metrics := range summary.Data {
 						text := summary.Name + "." + name
 						if err := writeToCarbon(writer, metrics.Keys, text, when, dt); err != nil {
 							conn.Close()
+							conn = nil
 							break
 						}
 					}
@@ -83,6 +123,38 @@ func (carbon *CarbonPublisher) initialize() {
 	}
 }
 
+// Stop closes the connections once the summaries already sent are written.
+// The publisher can't be used once stopped and stopping it again returns an error.
+func (carbon *CarbonPublisher) Stop(c context.Context) error {
+	carbon.once.Do(carbon.initialize)
+
+	carbon.mu.Lock()
+	stopped := carbon.stopped
+	carbon.stopped = true
+	carbon.mu.Unlock()
+
+	if stopped {
+		return ErrStopped
+	}
+
+	for i := range carbon.feed {
+		close(carbon.feed[i])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		carbon.busy.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
 // NewCarbonMonitor creates a monitor that writes the summary of metrics to Carbon daemons at the specified URLs.
 func NewCarbonMonitor(name string, urls []string) (monitor *Monitor) {
 	monitor = &Monitor{
@@ -106,19 +178,38 @@ func writeToCarbon(w io.Writer, metrics map[string]Metric, name string, when int
 		switch m := metric.(interface{}).(type) {
 		case *Bool:
 			write(text, float64(m.Count)/dt)
-		case *Int:
-			_ = write(text+".Average", m.Average) &&
-				write(text+".Maximum", float64(m.Maximum)) &&
-				write(text+".Minimum", float64(m.Minimum))
-		case *Float:
-			_ = write(text+".Average", m.Average) &&
-				write(text+".Maximum", m.Maximum) &&
-				write(text+".Minimum", m.Minimum)
-		case *Duration:
-			s := float64(time.Second)
-			_ = write(text+".Average", m.Average/s) &&
-				write(text+".Maximum", float64(m.Maximum)/s) &&
-				write(text+".Minimum", float64(m.Minimum)/s)
+		case statistics:
+			st := m.statistics()
+			ok := write(text+".Average", st.Average) &&
+				write(text+".Maximum", st.Maximum) &&
+				write(text+".Minimum", st.Minimum) &&
+				write(text+".Count", st.Count/dt) &&
+				write(text+".Sum", st.Sum/dt) &&
+				write(text+".Variance", st.Variance) &&
+				write(text+".StdDev", st.StdDev)
+			if !ok {
+				break
+			}
+
+			for key, value := range st.Percentiles {
+				if !write(text+"."+key, value) {
+					return
+				}
+			}
+		case *Counter:
+			write(text, m.Total/dt)
+		case *Gauge:
+			write(text, m.Value)
+		case *Histogram:
+			if !write(text+".Minimum", m.Minimum) || !write(text+".Maximum", m.Maximum) {
+				return
+			}
+
+			for key, value := range m.Percentiles() {
+				if !write(text+"."+key, value) {
+					return
+				}
+			}
 		case *String:
 			for key, value := range m.Items {
 				if !write(text+"."+key, float64(value)/dt) {
@@ -132,7 +223,7 @@ func writeToCarbon(w io.Writer, metrics map[string]Metric, name string, when int
 				}
 			}
 		default:
-			log.Panicf("unknown metric %+v", m)
+			report.HandleError(fmt.Errorf("metric: unknown metric %T", m))
 		}
 	}
 
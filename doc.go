@@ -21,9 +21,12 @@ aggregated.
 		Latency time.Duration
 	}
 
-Supported types are currently limited to some basic types (bool, int, float64,
-string, time.Duration) and can contain a map of string to another structure of
-metrics.
+Supported types include booleans, integers and floating points of any size,
+strings, time.Duration, time.Time and types implementing fmt.Stringer. Pointers
+are followed and skipped when nil. Slices and arrays of numbers are recorded
+element-wise into an histogram. Structures can be nested and can contain a map
+of string to another structure of metrics. Types implementing MetricRecorder
+record their own metrics.
 
 	type LotsOfMetrics struct {
 		InFlight int
@@ -32,8 +35,23 @@ metrics.
 
 A boolean metric is normally used for events as it counts the number of times it
 was recorded as true. Numerical metrics (duration included) keep track of more
-information like their minimal, maximum and average values. Finally, the string
-metric counts the number of occurences of each recorded values.
-
+information like their minimal, maximum and average values along with their
+count, sum, variance and standard deviation. Finally, the string metric counts
+the number of occurences of each recorded values.
+
+Struct tags can rename a metric, skip it or change how it is aggregated. The
+tag has the form `metric:"name,kind"` where a name of '-' skips the member.
+Numerical and boolean members support the 'counter', 'gauge' and 'histogram'
+kinds while the 'ignore' kind skips a member of any type. The 'percentiles'
+option also estimates the percentiles of numerical members. Like the other
+statistics of durations, their percentiles are in nanoseconds in JSON and in
+seconds when written to reporters.
+
+	type TaggedMetrics struct {
+		Latency time.Duration `metric:"RequestLatency,histogram"`
+		Bytes   int           `metric:",counter"`
+		Debug   string        `metric:"-"`
+		Wait    time.Duration `metric:",stats,percentiles"`
+	}
 */
 package metric
@@ -0,0 +1,259 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	report "github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
+)
+
+// JSONPublisher POSTs the summary of metrics as a JSON object to an URL.
+// Summaries are sent in the background from a bounded backlog so that an unreachable collector never blocks the monitor.
+// Failures are counted and published with the next summaries under the 'JSONPublisher' key.
+type JSONPublisher struct {
+	// URL contains the address where summaries are posted.
+	URL string
+	// Client is optional and contains the HTTP client used to post summaries e.g. to specify timeouts.
+	Client *http.Client
+	// Header contains additional headers sent with every request e.g. for authentication.
+	Header http.Header
+	// Gzip compresses the body of every request.
+	Gzip bool
+	// Retries contains the number of attempts made to post a summary before dropping it. Will use 3 if 0.
+	Retries int
+	// Backoff contains the delay before the first retry and doubles after every attempt up to a minute. Will use 1s if 0.
+	Backoff time.Duration
+	// Backlog contains the number of unsent summaries that are kept. Will use 16 if 0.
+	// When full, the oldest summary is dropped.
+	Backlog int
+
+	once     sync.Once
+	mu       sync.Mutex
+	queue    []*Summary
+	wake     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopping bool
+	errors   int
+	failures int
+	dropped  int
+}
+
+// Send queues the summary to be posted in the background.
+func (p *JSONPublisher) Send(s *Summary) {
+	p.once.Do(p.initialize)
+
+	p.mu.Lock()
+	if p.stopping {
+		p.mu.Unlock()
+		report.HandleError(fmt.Errorf("json: dropping summary '%s': %s", s.Name, report.ErrStopped))
+		return
+	}
+
+	p.queue = append(p.queue, s)
+	if n := p.Backlog; len(p.queue) > n {
+		p.queue = p.queue[len(p.queue)-n:]
+		p.dropped++
+	}
+	p.mu.Unlock()
+
+	p.signal()
+}
+
+// Stop waits for the backlog to be sent or the context to be done.
+// The publisher can't be used once stopped: summaries sent afterwards are dropped and stopping again returns ErrStopped.
+func (p *JSONPublisher) Stop(c context.Context) error {
+	p.once.Do(p.initialize)
+
+	p.mu.Lock()
+	stopping := p.stopping
+	p.stopping = true
+	p.mu.Unlock()
+
+	if stopping {
+		return ErrStopped
+	}
+
+	p.signal()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-c.Done():
+		close(p.quit)
+		return c.Err()
+	}
+}
+
+func (p *JSONPublisher) initialize() {
+	p.Client = defaults.Client(p.Client)
+	p.Backoff = defaults.Duration(p.Backoff, time.Second)
+
+	if p.Retries == 0 {
+		p.Retries = 3
+	}
+
+	if p.Backlog == 0 {
+		p.Backlog = 16
+	}
+
+	p.wake = make(chan struct{}, 1)
+	p.quit = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go func() {
+		defer close(p.done)
+
+		for {
+			select {
+			case <-p.wake:
+			case <-p.quit:
+				return
+			}
+
+			if !p.flush() {
+				return
+			}
+		}
+	}()
+}
+
+func (p *JSONPublisher) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush sends the queued summaries and returns false when the publisher is stopped.
+func (p *JSONPublisher) flush() bool {
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			stopping := p.stopping
+			p.mu.Unlock()
+			return !stopping
+		}
+
+		s := p.queue[0]
+		p.queue = p.queue[1:]
+		p.record(s)
+		p.mu.Unlock()
+
+		if !p.sendWithRetries(s) {
+			return false
+		}
+	}
+}
+
+// record adds the failures of the publisher to the summary.
+func (p *JSONPublisher) record(s *Summary) {
+	if s.Data == nil {
+		s.Data = make(map[string]*Metrics)
+	}
+
+	s.Data["JSONPublisher"] = &Metrics{
+		Keys: map[string]Metric{
+			"Errors":   &Counter{Total: float64(p.errors)},
+			"Failures": &Counter{Total: float64(p.failures)},
+			"Dropped":  &Counter{Total: float64(p.dropped)},
+		},
+	}
+
+	p.errors = 0
+	p.failures = 0
+	p.dropped = 0
+}
+
+// sendWithRetries posts the summary until it succeeds or the number of retries is exhausted.
+// It returns false if the publisher was stopped while waiting to retry.
+func (p *JSONPublisher) sendWithRetries(s *Summary) bool {
+	backoff := report.Backoff{Delay: p.Backoff, Attempts: p.Retries}
+	err := backoff.Retry(p.quit, func(attempt int) (bool, error) {
+		err := p.send(s)
+		if err != nil {
+			report.HandleError(fmt.Errorf("json: %s", err))
+
+			p.mu.Lock()
+			p.errors++
+			p.mu.Unlock()
+		}
+
+		return true, err
+	})
+
+	switch err {
+	case nil:
+	case report.ErrStopped:
+		return false
+	default:
+		p.mu.Lock()
+		p.failures++
+		p.mu.Unlock()
+	}
+
+	return true
+}
+
+func (p *JSONPublisher) send(s *Summary) (err error) {
+	text, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+
+	body := &bytes.Buffer{}
+	if p.Gzip {
+		w := gzip.NewWriter(body)
+		if _, err = w.Write(text); err != nil {
+			return
+		}
+
+		if err = w.Close(); err != nil {
+			return
+		}
+	} else {
+		body.Write(text)
+	}
+
+	req, err := http.NewRequest("POST", p.URL, body)
+	if err != nil {
+		return
+	}
+
+	for key, values := range p.Header {
+		req.Header[key] = values
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if p.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	r, err := p.Client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if _, err = io.Copy(ioutil.Discard, r.Body); err != nil {
+		return
+	}
+
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		err = fmt.Errorf("unexpected status '%s' from '%s'", r.Status, p.URL)
+	}
+
+	return
+}
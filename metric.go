@@ -3,9 +3,15 @@
 package metric
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
+	"math/rand"
 	"reflect"
+	"sort"
 	"time"
+
+	report "github.com/datacratic/gometrics/metric"
 )
 
 // Metric defines an interface for metrics of different types.
@@ -14,6 +20,11 @@ type Metric interface {
 	Record(value interface{})
 }
 
+// unknown reports a value of an unexpected type for the metric.
+func unknown(metric Metric, value interface{}) {
+	report.HandleError(fmt.Errorf("metric: unknown type %T for %T", value, metric))
+}
+
 // Bool implements support for boolean metrics.
 type Bool struct {
 	Count int
@@ -21,7 +32,12 @@ type Bool struct {
 
 // Record keeps track of the number of times the boolean value was true.
 func (metric *Bool) Record(value interface{}) {
-	v := value.(bool)
+	v, ok := value.(bool)
+	if !ok {
+		unknown(metric, value)
+		return
+	}
+
 	if v {
 		metric.Count++
 	}
@@ -29,45 +45,81 @@ func (metric *Bool) Record(value interface{}) {
 
 // Int implements support for numerical integral metrics.
 type Int struct {
-	Average float64
-	Maximum int
-	Minimum int
-	total   int
-	count   int
+	Average     float64
+	Maximum     int
+	Minimum     int
+	Count       int
+	Sum         int
+	Variance    float64
+	StdDev      float64
+	Percentiles *Reservoir `json:",omitempty"`
+	moments     moments
 }
 
-// Record keeps track of the minimum, maximum and average value of integers.
+// Record keeps track of the minimum, maximum, average, variance and optional percentiles of integers.
 func (metric *Int) Record(value interface{}) {
-	v := value.(int)
-	metric.total += v
+	v, ok := value.(int)
+	if !ok {
+		unknown(metric, value)
+		return
+	}
 
-	if metric.count == 0 || v > metric.Maximum {
+	metric.Sum += v
+
+	if metric.Count == 0 || v > metric.Maximum {
 		metric.Maximum = v
 	}
 
-	if metric.count == 0 || v < metric.Minimum {
+	if metric.Count == 0 || v < metric.Minimum {
 		metric.Minimum = v
 	}
 
-	metric.count++
-	metric.Average = float64(metric.total) / float64(metric.count)
+	metric.Count++
+	metric.Average = float64(metric.Sum) / float64(metric.Count)
+	metric.Variance, metric.StdDev = metric.moments.update(float64(v), metric.Count)
+
+	if metric.Percentiles != nil {
+		metric.Percentiles.Record(float64(v))
+	}
+}
+
+func (metric *Int) statistics() stats {
+	return stats{
+		Average:     metric.Average,
+		Maximum:     float64(metric.Maximum),
+		Minimum:     float64(metric.Minimum),
+		Count:       float64(metric.Count),
+		Sum:         float64(metric.Sum),
+		Variance:    metric.Variance,
+		StdDev:      metric.StdDev,
+		Percentiles: percentiles(metric.Percentiles, 1),
+	}
 }
 
 // Float implements support for numerical floating point metrics.
 type Float struct {
-	Average float64
-	Maximum float64
-	Minimum float64
-	total   float64
-	count   int
+	Average     float64
+	Maximum     float64
+	Minimum     float64
+	Count       int
+	Sum         float64
+	Variance    float64
+	StdDev      float64
+	Percentiles *Reservoir `json:",omitempty"`
+	moments     moments
 }
 
-// Record keeps track of the minimum, maximum and average value of floating points.
+// Record keeps track of the minimum, maximum, average, variance and optional percentiles of floating points.
 func (metric *Float) Record(value interface{}) {
-	v := value.(float64)
-	metric.total += v
+	v, ok := value.(float64)
+	if !ok {
+		unknown(metric, value)
+		return
+	}
+
+	metric.Sum += v
 
-	if metric.count == 0 {
+	if metric.Count == 0 {
 		metric.Maximum = v
 		metric.Minimum = v
 	}
@@ -75,25 +127,209 @@ func (metric *Float) Record(value interface{}) {
 	metric.Maximum = math.Max(v, metric.Maximum)
 	metric.Minimum = math.Min(v, metric.Minimum)
 
-	metric.count++
-	metric.Average = metric.total / float64(metric.count)
+	metric.Count++
+	metric.Average = metric.Sum / float64(metric.Count)
+	metric.Variance, metric.StdDev = metric.moments.update(v, metric.Count)
+
+	if metric.Percentiles != nil {
+		metric.Percentiles.Record(v)
+	}
+}
+
+func (metric *Float) statistics() stats {
+	return stats{
+		Average:     metric.Average,
+		Maximum:     metric.Maximum,
+		Minimum:     metric.Minimum,
+		Count:       float64(metric.Count),
+		Sum:         metric.Sum,
+		Variance:    metric.Variance,
+		StdDev:      metric.StdDev,
+		Percentiles: percentiles(metric.Percentiles, 1),
+	}
 }
 
 // Duration implements support for time duration metrics.
+// Values and percentiles are kept in nanoseconds and converted to seconds when reported.
 type Duration struct {
-	Average float64
-	Maximum int64
-	Minimum int64
-	total   int64
-	count   int
+	Average     float64
+	Maximum     int64
+	Minimum     int64
+	Count       int
+	Sum         int64
+	Variance    float64
+	StdDev      float64
+	Percentiles *Reservoir `json:",omitempty"`
+	moments     moments
 }
 
-// Record keeps track of the minimum, maximum and average value of time durations.
+// Record keeps track of the minimum, maximum, average, variance and optional percentiles of time durations.
 func (metric *Duration) Record(value interface{}) {
-	d := value.(time.Duration)
+	d, ok := value.(time.Duration)
+	if !ok {
+		unknown(metric, value)
+		return
+	}
+
 	v := int64(d)
 
-	metric.total += v
+	metric.Sum += v
+
+	if metric.Count == 0 || v > metric.Maximum {
+		metric.Maximum = v
+	}
+
+	if metric.Count == 0 || v < metric.Minimum {
+		metric.Minimum = v
+	}
+
+	metric.Count++
+	metric.Average = float64(metric.Sum) / float64(metric.Count)
+	metric.Variance, metric.StdDev = metric.moments.update(float64(v), metric.Count)
+
+	if metric.Percentiles != nil {
+		metric.Percentiles.Record(float64(v))
+	}
+}
+
+func (metric *Duration) statistics() stats {
+	s := float64(time.Second)
+	return stats{
+		Average:     metric.Average / s,
+		Maximum:     float64(metric.Maximum) / s,
+		Minimum:     float64(metric.Minimum) / s,
+		Count:       float64(metric.Count),
+		Sum:         float64(metric.Sum) / s,
+		Variance:    metric.Variance / (s * s),
+		StdDev:      metric.StdDev / s,
+		Percentiles: percentiles(metric.Percentiles, s),
+	}
+}
+
+// stats contains the statistics of numerical metrics in a common unit.
+type stats struct {
+	Average  float64
+	Maximum  float64
+	Minimum  float64
+	Count    float64
+	Sum      float64
+	Variance float64
+	StdDev   float64
+	// Percentiles is nil when they are not estimated.
+	Percentiles map[string]float64
+}
+
+// percentiles returns the estimated percentiles divided by the unit or nil without reservoir.
+func percentiles(r *Reservoir, unit float64) map[string]float64 {
+	if r == nil {
+		return nil
+	}
+
+	values := r.Values()
+	for key, value := range values {
+		values[key] = value / unit
+	}
+
+	return values
+}
+
+// statistics is implemented by the numerical metrics that keep track of statistics.
+type statistics interface {
+	statistics() stats
+}
+
+// moments computes a running variance using Welford's algorithm.
+type moments struct {
+	mean float64
+	m2   float64
+}
+
+// update adds the n-th value and returns the population variance and standard deviation.
+func (m *moments) update(v float64, n int) (variance, stddev float64) {
+	delta := v - m.mean
+	m.mean += delta / float64(n)
+	m.m2 += delta * (v - m.mean)
+
+	variance = m.m2 / float64(n)
+	stddev = math.Sqrt(variance)
+	return
+}
+
+// Reservoir estimates the 50th, 90th and 99th percentiles of a stream of values.
+// It uses reservoir sampling of 1000 items.
+type Reservoir struct {
+	count int
+	items []float64
+}
+
+// Record adds a sample to the reservoir.
+func (r *Reservoir) Record(v float64) {
+	if n := len(r.items); n < 1000 {
+		r.items = append(r.items, v)
+	} else if i := rand.Intn(r.count + 1); i < n {
+		r.items[i] = v
+	}
+
+	r.count++
+}
+
+// Values returns the estimated percentiles.
+func (r *Reservoir) Values() map[string]float64 {
+	result := make(map[string]float64)
+	if len(r.items) == 0 {
+		return result
+	}
+
+	items := make([]float64, len(r.items))
+	copy(items, r.items)
+	sort.Float64s(items)
+
+	k := float64(len(items))
+	result["50th"] = items[int(k*0.5)]
+	result["90th"] = items[int(k*0.9)]
+	result["99th"] = items[int(k*0.99)]
+	return result
+}
+
+// MarshalJSON writes the estimated percentiles.
+func (r *Reservoir) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Values())
+}
+
+// Counter implements support for numerical metrics that are summed over the period.
+// Durations are converted to seconds and booleans to 0 or 1.
+type Counter struct {
+	Total float64
+}
+
+// Record adds the value to the total.
+func (metric *Counter) Record(value interface{}) {
+	metric.Total += toFloat(value)
+}
+
+// Gauge implements support for numerical metrics where only the last value is kept.
+// Durations are converted to seconds and booleans to 0 or 1.
+type Gauge struct {
+	Value float64
+}
+
+// Record keeps the last value.
+func (metric *Gauge) Record(value interface{}) {
+	metric.Value = toFloat(value)
+}
+
+// Histogram implements support for the distribution of numerical metrics.
+// Durations are converted to seconds and booleans to 0 or 1.
+type Histogram struct {
+	Minimum   float64
+	Maximum   float64
+	count     int
+	reservoir Reservoir
+}
+
+// Record adds a sample to the distribution.
+func (metric *Histogram) Record(value interface{}) {
+	v := toFloat(value)
 
 	if metric.count == 0 || v > metric.Maximum {
 		metric.Maximum = v
@@ -103,8 +339,43 @@ func (metric *Duration) Record(value interface{}) {
 		metric.Minimum = v
 	}
 
+	metric.reservoir.Record(v)
 	metric.count++
-	metric.Average = float64(metric.total) / float64(metric.count)
+}
+
+// Percentiles returns the 50th, 90th and 99th percentiles of the distribution.
+func (metric *Histogram) Percentiles() map[string]float64 {
+	return metric.reservoir.Values()
+}
+
+// MarshalJSON includes the percentiles along with the extremes of the distribution.
+func (metric *Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Minimum     float64
+		Maximum     float64
+		Percentiles map[string]float64
+	}{
+		Minimum:     metric.Minimum,
+		Maximum:     metric.Maximum,
+		Percentiles: metric.Percentiles(),
+	})
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1
+		}
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	case time.Duration:
+		return v.Seconds()
+	}
+
+	return 0
 }
 
 // String implements support for string multiplicity metrics.
@@ -114,7 +385,12 @@ type String struct {
 
 // Record keeps track of the number of times a string was encountered.
 func (metric *String) Record(value interface{}) {
-	s := value.(string)
+	s, ok := value.(string)
+	if !ok {
+		unknown(metric, value)
+		return
+	}
+
 	if s != "" {
 		v := metric.Items[s]
 		v++
@@ -122,7 +398,8 @@ func (metric *String) Record(value interface{}) {
 	}
 }
 
-// Map implements support for map of strings to metrics.
+// Map implements support for maps of metrics.
+// Keys of any type are converted to strings with fmt.Sprint.
 type Map struct {
 	Items map[string]map[string]Metric
 }
@@ -132,7 +409,8 @@ func (metric *Map) Record(value interface{}) {
 	v := reflect.ValueOf(value)
 	k := v.MapKeys()
 	for _, i := range k {
-		name := i.Interface().(string)
+		// keys of any type are formatted e.g. integers or named strings
+		name := fmt.Sprint(i.Interface())
 
 		item, ok := metric.Items[name]
 		if !ok {
@@ -11,19 +11,40 @@ import (
 	"net/url"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
 )
 
 // Carbon enables writing summary of metrics to Carbon daemons at the specified URLs.
+// The state of every connection, the reconnect attempts, the volume sent and the number of pending summaries are added to the telemetry.
 type Carbon struct {
 	// URLs contains a list of addresses used to dial e.g. tcp://127.0.0.1:2023.
 	URLs []string
 	// Prefix contains the path under which all keys will be written.
 	Prefix string
+	// Tagger is optional and writes Graphite tagged series e.g. 'Requests;host=web1' with the tags extracted from every key.
+	// Characters that are not allowed in tags are replaced by an underscore and tags with empty values are skipped.
+	Tagger *Tagger
 
 	once sync.Once
 	conn []*carbonConn
 	path string
+	busy deliveries
+	// pending contains the number of summaries that are not yet delivered to every connection.
+	pending int64
+}
+
+// NewCarbon returns a reporter that writes metrics under the prefix to the Carbon daemons at the specified URLs.
+// It returns an error if an URL is invalid.
+func NewCarbon(prefix string, urls ...string) (*Carbon, error) {
+	for _, address := range urls {
+		if _, _, err := parseAddress(address); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Carbon{URLs: urls, Prefix: prefix}, nil
 }
 
 // NewWriter creates a new Carbon writer that will send the aggregated summary metrics to all connections.
@@ -47,32 +68,63 @@ func (carbon *Carbon) initialize() {
 	}
 
 	carbon.path = path
-	carbon.conn = make([]*carbonConn, len(carbon.URLs))
 
-	for i, url := range carbon.URLs {
-		conn := carbon.connect(i, url)
-		go func() {
-			for f := range conn.feed {
-				f()
-			}
-		}()
+	for _, url := range carbon.URLs {
+		conn, err := carbon.connect(url)
+		if err != nil {
+			HandleError(err)
+			continue
+		}
+
+		go conn.run()
 	}
 }
 
-func (carbon *Carbon) connect(i int, address string) *carbonConn {
+func (carbon *Carbon) connect(address string) (*carbonConn, error) {
+	network, host, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newCarbonConn("Carbon", network, host)
+	carbon.conn = append(carbon.conn, conn)
+	return conn, nil
+}
+
+// parseAddress splits an URL like tcp://127.0.0.1:2003 into the network and the address used to dial.
+func parseAddress(address string) (network, host string, err error) {
 	u, err := url.Parse(address)
 	if err != nil {
-		log.Fatalf("url '%s': %s", address, err)
+		err = fmt.Errorf("carbon: invalid url '%s': %s", address, err)
+		return
 	}
 
-	conn := &carbonConn{
-		feed:    make(chan func()),
-		network: u.Scheme,
-		address: u.Host,
+	if u.Scheme == "" || u.Host == "" {
+		err = fmt.Errorf("carbon: invalid url '%s': missing network or address", address)
+		return
 	}
 
-	carbon.conn[i] = conn
-	return conn
+	network, host = u.Scheme, u.Host
+	return
+}
+
+// Stop waits for the pending metrics to be delivered to every connection.
+// When the context is done first, pending metrics are dropped.
+// Connections are closed once the remaining deliveries are aborted.
+// Summaries written afterwards are dropped and stopping again returns ErrStopped.
+func (carbon *Carbon) Stop(c context.Context) error {
+	carbon.once.Do(carbon.initialize)
+
+	err := carbon.busy.stop(c)
+	if err == ErrStopped {
+		return err
+	}
+
+	for _, conn := range carbon.conn {
+		conn.stop()
+	}
+
+	return err
 }
 
 type carbonWriter struct {
@@ -84,29 +136,62 @@ type carbonWriter struct {
 }
 
 func (w *carbonWriter) Write(name string, value float64) (err error) {
-	_, err = fmt.Fprintf(&w.buffer, w.format, name, value)
+	_, err = fmt.Fprintf(&w.buffer, w.format, w.series(name), value)
 	return
 }
 
 func (w *carbonWriter) WriteScaled(name string, value float64) (err error) {
-	_, err = fmt.Fprintf(&w.buffer, w.format, name, value/w.dt)
+	_, err = fmt.Fprintf(&w.buffer, w.format, w.series(name), value/w.dt)
 	return
 }
 
+// series returns the name of the series with its tags when the reporter has a tagger.
+func (w *carbonWriter) series(name string) string {
+	if w.carbon.Tagger == nil {
+		return name
+	}
+
+	name, tags := w.carbon.Tagger.Split(name)
+	text := rewrite(SanitizeGraphiteTag, name)
+	for _, key := range sortedTags(tags) {
+		if value := rewrite(SanitizeGraphiteTag, tags[key]); value != "" {
+			text += ";" + rewrite(SanitizeGraphiteTag, key) + "=" + value
+		}
+	}
+
+	return text
+}
+
 func (w *carbonWriter) WriteString(name, text string) (err error) {
 	err = ErrIgnored
 	return
 }
 
 func (w *carbonWriter) Close() {
+	if !w.carbon.busy.add() {
+		HandleError(fmt.Errorf("carbon: dropping summary: %s", ErrStopped))
+		return
+	}
+
+	Self.Set("Carbon.Backlog", float64(atomic.AddInt64(&w.carbon.pending, 1)))
+
 	go func() {
+		defer w.carbon.busy.done()
+		defer func() {
+			Self.Set("Carbon.Backlog", float64(atomic.AddInt64(&w.carbon.pending, -1)))
+		}()
+
 		var wg sync.WaitGroup
 
 		for i, n := 0, len(w.carbon.conn); i < n; i++ {
 			wg.Add(1)
 			conn := w.carbon.conn[i]
-			conn.feed <- func() {
-				conn.send(w.buffer.Bytes())
+			ok := conn.deliver(func() {
+				conn.send(w.buffer.Bytes(), bytes.Count(w.buffer.Bytes(), []byte("\n")))
+				wg.Done()
+			})
+
+			if !ok {
 				wg.Done()
 			}
 		}
@@ -115,44 +200,103 @@ func (w *carbonWriter) Close() {
 	}()
 }
 
+// carbonConn delivers lines of text over a stream connection that is reestablished on failures.
+// It is shared by the reporters using a plaintext protocol.
 type carbonConn struct {
 	conn    net.Conn
 	feed    chan func()
+	quit    chan struct{}
 	network string
 	address string
+	// kind contains the name of the reporter used in logs and telemetry e.g. 'Carbon'.
+	kind string
+	key  string
 }
 
-func (carbon *carbonConn) send(data []byte) {
-	retry := 0
-	sleep := time.Second
+func newCarbonConn(kind, network, address string) *carbonConn {
+	conn := &carbonConn{
+		feed:    make(chan func()),
+		quit:    make(chan struct{}),
+		network: network,
+		address: address,
+		kind:    kind,
+		key:     kind + "." + telemetryName(address),
+	}
+
+	Self.Set(conn.key+".Connected", 0)
+	return conn
+}
 
+// run processes the deliveries until the connection is stopped.
+func (carbon *carbonConn) run() {
 	for {
-		if retry != 0 {
-			log.Printf("carbon: connect attempt %d to '%s://%s'\n", retry, carbon.network, carbon.address)
+		select {
+		case f := <-carbon.feed:
+			f()
+		case <-carbon.quit:
+			carbon.close()
+			return
 		}
+	}
+}
 
-		err := carbon.write(data)
-		if err == nil {
-			break
-		}
+// deliver queues the function and returns false if the connection is stopped first.
+func (carbon *carbonConn) deliver(f func()) bool {
+	select {
+	case carbon.feed <- f:
+		return true
+	case <-carbon.quit:
+		return false
+	}
+}
 
-		log.Printf("carbon: %s\n", err)
+// stop aborts the current delivery and closes the connection.
+// It must be called once.
+func (carbon *carbonConn) stop() {
+	close(carbon.quit)
+}
 
-		if carbon.conn != nil {
-			if err = carbon.conn.Close(); err != nil {
-				log.Printf("carbon: %s\n", err)
-			}
+func (carbon *carbonConn) errorf(format string, args ...interface{}) {
+	HandleError(fmt.Errorf(strings.ToLower(carbon.kind)+": "+format, args...))
+}
 
-			carbon.conn = nil
+// send writes the data containing the specified number of lines or messages until it succeeds or the connection is stopped.
+func (carbon *carbonConn) send(data []byte, lines int) {
+	err := Backoff{}.Retry(carbon.quit, func(attempt int) (bool, error) {
+		if attempt != 0 {
+			log.Printf("%s: connect attempt %d to '%s://%s'\n", strings.ToLower(carbon.kind), attempt, carbon.network, carbon.address)
+			Self.Count(carbon.key+".Reconnects", 1)
 		}
 
-		time.Sleep(sleep)
-		if sleep < time.Minute {
-			sleep += sleep
+		err := carbon.write(data)
+		if err != nil {
+			carbon.errorf("%s", err)
+			carbon.close()
 		}
 
-		retry++
+		return true, err
+	})
+
+	if err != nil {
+		carbon.errorf("dropping %d bytes for '%s://%s'", len(data), carbon.network, carbon.address)
+		return
 	}
+
+	Self.Count(carbon.key+".Bytes", float64(len(data)))
+	Self.Count(carbon.key+".Lines", float64(lines))
+}
+
+func (carbon *carbonConn) close() {
+	if carbon.conn == nil {
+		return
+	}
+
+	if err := carbon.conn.Close(); err != nil {
+		carbon.errorf("%s", err)
+	}
+
+	carbon.conn = nil
+	Self.Set(carbon.key+".Connected", 0)
 }
 
 func (carbon *carbonConn) write(data []byte) (err error) {
@@ -162,7 +306,8 @@ func (carbon *carbonConn) write(data []byte) (err error) {
 			return
 		}
 
-		log.Printf("carbon: connected at '%s://%s'\n", carbon.network, carbon.address)
+		log.Printf("%s: connected at '%s://%s'\n", strings.ToLower(carbon.kind), carbon.network, carbon.address)
+		Self.Set(carbon.key+".Connected", 1)
 	}
 
 	_, err = io.Copy(carbon.conn, bytes.NewReader(data))
@@ -0,0 +1,132 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and periodic tickers.
+// It allows time-based metrics and periodic reports to be tested deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a ticker that delivers the time periodically.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a clock at regular intervals.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// DefaultClock contains the clock used when none is specified.
+var DefaultClock Clock = systemClock{}
+
+func clockOf(c Clock) Clock {
+	if c == nil {
+		return DefaultClock
+	}
+
+	return c
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock implements a clock that only moves forward when advanced manually.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a fake clock set at the specified time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the fake clock.
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// NewTicker returns a ticker that fires when the fake clock is advanced past its period.
+func (clock *FakeClock) NewTicker(d time.Duration) Ticker {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	t := &fakeTicker{
+		clock: clock,
+		c:     make(chan time.Time, 1),
+		d:     d,
+		next:  clock.now.Add(d),
+	}
+
+	clock.tickers = append(clock.tickers, t)
+	return t
+}
+
+// Advance moves the fake clock forward and fires the tickers that are due.
+// As with time.Ticker, ticks are dropped when the receiver falls behind.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	clock.now = clock.now.Add(d)
+
+	for _, t := range clock.tickers {
+		for !t.next.After(clock.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+
+			t.next = t.next.Add(t.d)
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	c     chan time.Time
+	d     time.Duration
+	next  time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, item := range t.clock.tickers {
+		if item == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			break
+		}
+	}
+}
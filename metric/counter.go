@@ -3,7 +3,7 @@
 package metric
 
 import (
-	"log"
+	"fmt"
 	"time"
 )
 
@@ -18,7 +18,8 @@ func (counter *Counter) Record(data interface{}) {
 	value := 0.0
 	switch item := data.(type) {
 	default:
-		log.Panicf("unknown type %T", data)
+		HandleError(fmt.Errorf("metric: unknown type %T for counter", data))
+		return
 	case bool:
 		if item {
 			value = 1.0
@@ -34,7 +35,7 @@ func (counter *Counter) Record(data interface{}) {
 	}
 
 	if value < 0 {
-		log.Printf("counter increment of '%f' is not monotonically-increasing\n", value)
+		HandleError(fmt.Errorf("metric: counter increment of '%f' is not monotonically-increasing", value))
 		return
 	}
 
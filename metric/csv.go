@@ -0,0 +1,287 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// CSV appends the summary of metrics to CSV files for offline analysis.
+// In the long format, every metric is a row with the columns 'timestamp', 'step', 'name', 'kind' and 'value' where the kind is 'value', 'rate' or 'string'.
+// In the wide format, every summary is a row with the columns 'timestamp', 'step' followed by a column per metric.
+type CSV struct {
+	// Filename is optional and contains the name of the file.
+	// When empty, rows are written to stdout and files are never rolled.
+	// If the filename contains a '%s', it will be replaced by the UTC start of the rolling period e.g. 'metrics-%s.csv' becomes 'metrics-2015-01-01T10.csv'.
+	// When files are rolled and there is no '%s', the period is added before the extension e.g. 'metrics.csv' also becomes 'metrics-2015-01-01T10.csv'.
+	Filename string
+	// Roll contains the duration covered by every file e.g. time.Hour or 24 * time.Hour.
+	// Files are never rolled if 0.
+	Roll time.Duration
+	// Wide writes a single row per summary.
+	Wide bool
+	// Columns is optional and contains the metrics written in the wide format.
+	// When empty, the columns are those of the first summary or read from the header of an existing file.
+	// Metrics without a column are ignored and missing metrics are left empty.
+	Columns []string
+
+	once    sync.Once
+	mu      sync.Mutex
+	file    *os.File
+	output  *csv.Writer
+	current string
+	columns map[string]int
+	stopped bool
+}
+
+// NewWriter returns a writer that appends the rows of the summary when it is closed.
+func (c *CSV) NewWriter(s *Summary) Writer {
+	c.once.Do(c.initialize)
+
+	return &csvWriter{
+		csv:    c,
+		time:   s.Time,
+		dt:     s.Step.Seconds(),
+		values: make(map[string]string),
+	}
+}
+
+func (c *CSV) initialize() {
+	if c.Filename == "" {
+		c.output = csv.NewWriter(os.Stdout)
+	}
+
+	if len(c.Columns) != 0 {
+		c.setColumns(c.Columns)
+	}
+}
+
+// Stop closes the current file.
+// Summaries written afterwards are dropped and stopping again returns ErrStopped.
+func (c *CSV) Stop(ctx context.Context) error {
+	c.once.Do(c.initialize)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return ErrStopped
+	}
+
+	c.stopped = true
+	return c.close()
+}
+
+func (c *CSV) setColumns(names []string) {
+	c.Columns = names
+	c.columns = make(map[string]int, len(names))
+	for i, name := range names {
+		c.columns[name] = i
+	}
+}
+
+// filename returns the name of the file that contains the specified time.
+func (c *CSV) filename(t time.Time) string {
+	if c.Roll == 0 {
+		return c.Filename
+	}
+
+	name := c.Filename
+	if !strings.Contains(name, "%s") {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-%s" + ext
+	}
+
+	layout := "2006-01-02T15-04"
+	switch {
+	case c.Roll%(24*time.Hour) == 0:
+		layout = "2006-01-02"
+	case c.Roll%time.Hour == 0:
+		layout = "2006-01-02T15"
+	}
+
+	return strings.Replace(name, "%s", t.UTC().Truncate(c.Roll).Format(layout), 1)
+}
+
+// open rolls the file when the time falls in a new period and returns whether the header is needed.
+func (c *CSV) open(t time.Time) (header bool, err error) {
+	if c.Filename == "" {
+		header = c.current == ""
+		c.current = "-"
+		return
+	}
+
+	name := c.filename(t)
+	if name == c.current && c.file != nil {
+		return
+	}
+
+	if err = c.close(); err != nil {
+		return
+	}
+
+	c.file, err = os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		err = fmt.Errorf("csv: failed to open file '%s': %s", name, err)
+		return
+	}
+
+	c.current = name
+	c.output = csv.NewWriter(c.file)
+
+	info, err := c.file.Stat()
+	if err != nil {
+		err = fmt.Errorf("csv: %s", err)
+		return
+	}
+
+	if info.Size() == 0 {
+		header = true
+		return
+	}
+
+	// recover the columns of an existing wide file
+	if c.Wide && c.columns == nil {
+		if _, err = c.file.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+
+		var names []string
+		if names, err = csv.NewReader(c.file).Read(); err != nil {
+			err = fmt.Errorf("csv: failed to read the header of '%s': %s", name, err)
+			return
+		}
+
+		if len(names) >= 2 {
+			c.setColumns(names[2:])
+		}
+	}
+
+	return
+}
+
+func (c *CSV) close() (err error) {
+	if c.file == nil {
+		return
+	}
+
+	c.output.Flush()
+	if err = c.output.Error(); err == nil {
+		err = c.file.Close()
+	} else {
+		c.file.Close()
+	}
+
+	c.file = nil
+	return
+}
+
+// write appends the rows of a writer.
+func (c *CSV) write(w *csvWriter) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return fmt.Errorf("csv: dropping summary: %s", ErrStopped)
+	}
+
+	header, err := c.open(w.time)
+	if err != nil {
+		return err
+	}
+
+	timestamp := w.time.UTC().Format(time.RFC3339)
+	step := strconv.FormatFloat(w.dt, 'f', -1, 64)
+
+	if !c.Wide {
+		if header {
+			c.output.Write([]string{"timestamp", "step", "name", "kind", "value"})
+		}
+
+		for _, row := range w.rows {
+			c.output.Write(append([]string{timestamp, step}, row...))
+		}
+	} else {
+		if c.columns == nil {
+			names := make([]string, 0, len(w.values))
+			for name := range w.values {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+			c.setColumns(names)
+		}
+
+		if header {
+			c.output.Write(append([]string{"timestamp", "step"}, c.Columns...))
+		}
+
+		row := make([]string, len(c.Columns)+2)
+		row[0], row[1] = timestamp, step
+		for name, value := range w.values {
+			if i, ok := c.columns[name]; ok {
+				row[i+2] = value
+			}
+		}
+
+		c.output.Write(row)
+	}
+
+	c.output.Flush()
+	if err := c.output.Error(); err != nil {
+		return fmt.Errorf("csv: %s", err)
+	}
+
+	return nil
+}
+
+type csvWriter struct {
+	csv    *CSV
+	time   time.Time
+	dt     float64
+	rows   [][]string
+	values map[string]string
+}
+
+func (w *csvWriter) add(name, kind, value string) error {
+	if w.csv.Wide {
+		if kind == "string" {
+			return ErrIgnored
+		}
+
+		w.values[name] = value
+		return nil
+	}
+
+	w.rows = append(w.rows, []string{name, kind, value})
+	return nil
+}
+
+func (w *csvWriter) Write(name string, value float64) error {
+	return w.add(name, "value", strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (w *csvWriter) WriteScaled(name string, value float64) error {
+	return w.add(name, "rate", strconv.FormatFloat(value/w.dt, 'f', -1, 64))
+}
+
+func (w *csvWriter) WriteString(name, text string) error {
+	return w.add(name, "string", text)
+}
+
+func (w *csvWriter) Close() {
+	if err := w.csv.write(w); err != nil {
+		HandleError(err)
+	}
+}
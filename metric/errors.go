@@ -0,0 +1,66 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrorHandler is invoked with the recoverable errors detected by the library e.g. an invalid configuration or an unknown type of value.
+// Every error is counted before being passed on to the handler.
+type ErrorHandler func(err error)
+
+var (
+	// LogErrors writes errors to the standard logger. It is the default handler.
+	LogErrors ErrorHandler = func(err error) {
+		log.Println(err)
+	}
+
+	// PanicErrors panics on errors.
+	PanicErrors ErrorHandler = func(err error) {
+		panic(err)
+	}
+
+	// CountErrors only counts errors.
+	CountErrors ErrorHandler = func(err error) {}
+)
+
+var errorState = struct {
+	mu      sync.RWMutex
+	handler ErrorHandler
+	count   int64
+}{
+	handler: LogErrors,
+}
+
+// SetErrorHandler installs the handler invoked with the errors of the library.
+// Will use LogErrors if nil.
+func SetErrorHandler(handler ErrorHandler) {
+	if handler == nil {
+		handler = LogErrors
+	}
+
+	errorState.mu.Lock()
+	errorState.handler = handler
+	errorState.mu.Unlock()
+}
+
+// HandleError counts the error and passes it on to the current error handler.
+// Errors are also counted in the telemetry under 'Errors'.
+func HandleError(err error) {
+	atomic.AddInt64(&errorState.count, 1)
+	Self.Count("Errors", 1)
+
+	errorState.mu.RLock()
+	handler := errorState.handler
+	errorState.mu.RUnlock()
+
+	handler(err)
+}
+
+// ErrorCount returns the number of errors handled since the process started.
+func ErrorCount() int64 {
+	return atomic.LoadInt64(&errorState.count)
+}
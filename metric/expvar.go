@@ -0,0 +1,260 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Collector records metrics from another source into a summary e.g. before every report.
+type Collector interface {
+	Collect(s *Summary)
+}
+
+// published contains the names of the variables published by Expvar reporters so that they are never collected back.
+var published = struct {
+	sync.Mutex
+	names map[string]bool
+}{
+	names: make(map[string]bool),
+}
+
+// Expvar publishes the latest value of every metric as an expvar variable e.g. to be seen on /debug/vars.
+// The variable is a JSON object with the 'values' of numerical metrics and the 'strings' written by labels.
+// Rates are scaled by the period like Carbon does.
+type Expvar struct {
+	// Name contains the name of the published variable. Will use 'metrics' if empty.
+	Name string
+
+	once    sync.Once
+	mu      sync.Mutex
+	values  map[string]float64
+	strings map[string][]string
+}
+
+// NewWriter returns a writer that updates the published values when it is closed.
+func (e *Expvar) NewWriter(s *Summary) Writer {
+	e.once.Do(e.initialize)
+
+	return &expvarWriter{
+		e:      e,
+		dt:     s.Step.Seconds(),
+		values: make(map[string]float64),
+	}
+}
+
+func (e *Expvar) initialize() {
+	if e.Name == "" {
+		e.Name = "metrics"
+	}
+
+	e.values = make(map[string]float64)
+	e.strings = make(map[string][]string)
+
+	// expvar panics when a name is published twice
+	if expvar.Get(e.Name) != nil {
+		HandleError(fmt.Errorf("expvar: variable '%s' is already published", e.Name))
+		return
+	}
+
+	published.Lock()
+	published.names[e.Name] = true
+	published.Unlock()
+
+	expvar.Publish(e.Name, expvar.Func(e.snapshot))
+}
+
+// snapshot returns a copy of the latest values.
+func (e *Expvar) snapshot() interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	values := make(map[string]float64, len(e.values))
+	for name, value := range e.values {
+		values[name] = value
+	}
+
+	texts := make(map[string][]string, len(e.strings))
+	for name, text := range e.strings {
+		texts[name] = text
+	}
+
+	return map[string]interface{}{
+		"values":  values,
+		"strings": texts,
+	}
+}
+
+type expvarWriter struct {
+	e       *Expvar
+	dt      float64
+	values  map[string]float64
+	strings map[string][]string
+}
+
+// Write rejects values that can't be encoded in JSON so that the variable stays valid.
+func (w *expvarWriter) Write(name string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("expvar: invalid value %f for '%s'", value, name)
+	}
+
+	w.values[name] = value
+	return nil
+}
+
+func (w *expvarWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *expvarWriter) WriteString(name, text string) error {
+	if w.strings == nil {
+		w.strings = make(map[string][]string)
+	}
+
+	w.strings[name] = append(w.strings[name], text)
+	return nil
+}
+
+func (w *expvarWriter) Close() {
+	w.e.mu.Lock()
+	defer w.e.mu.Unlock()
+
+	for name, value := range w.values {
+		w.e.values[name] = value
+	}
+
+	for name, text := range w.strings {
+		w.e.strings[name] = text
+	}
+}
+
+// ExpvarCollector reads expvar variables into a summary.
+// Integers and floats are recorded with Set unless they match a counter pattern, in which case the increase since the last collection is recorded with Count.
+// Maps and other variables holding JSON objects like 'memstats' are recorded recursively with dotted keys while strings and arrays are skipped.
+// Variables published by Expvar reporters are never collected.
+type ExpvarCollector struct {
+	// Names contains glob patterns of the variables to collect e.g. {"memstats", "http*"}. Will collect every variable if empty.
+	Names []string
+	// Counters contains glob patterns of the keys whose values only increase e.g. {"requests.*"}.
+	// Patterns don't include the prefix.
+	Counters []string
+	// Prefix contains the path under which all keys will be recorded.
+	Prefix string
+
+	mu     sync.Mutex
+	last   map[string]float64
+	prefix string
+}
+
+// Collect records the selected variables in the summary.
+func (c *ExpvarCollector) Collect(s *Summary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last == nil {
+		c.last = make(map[string]float64)
+	}
+
+	c.prefix = c.Prefix
+	if c.prefix != "" && !strings.HasSuffix(c.prefix, ".") {
+		c.prefix += "."
+	}
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !matchAny(c.Names, kv.Key, true) {
+			return
+		}
+
+		published.Lock()
+		skip := published.names[kv.Key]
+		published.Unlock()
+
+		if !skip {
+			c.collect(s, kv.Key, kv.Value)
+		}
+	})
+}
+
+func (c *ExpvarCollector) collect(s *Summary, name string, v expvar.Var) {
+	switch item := v.(type) {
+	case *expvar.Int:
+		c.record(s, name, float64(item.Value()))
+	case *expvar.Float:
+		c.record(s, name, item.Value())
+	case *expvar.Map:
+		item.Do(func(kv expvar.KeyValue) {
+			c.collect(s, name+"."+kv.Key, kv.Value)
+		})
+	case *expvar.String:
+	default:
+		var data interface{}
+		if err := json.Unmarshal([]byte(v.String()), &data); err != nil {
+			HandleError(fmt.Errorf("expvar: invalid variable '%s': %s", name, err))
+			return
+		}
+
+		c.collectJSON(s, name, data)
+	}
+}
+
+func (c *ExpvarCollector) collectJSON(s *Summary, name string, data interface{}) {
+	switch item := data.(type) {
+	case float64:
+		c.record(s, name, item)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(item))
+		for key := range item {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			c.collectJSON(s, name+"."+key, item[key])
+		}
+	}
+}
+
+// record sets the value or counts its increase for counters.
+func (c *ExpvarCollector) record(s *Summary, name string, value float64) {
+	if !matchAny(c.Counters, name, false) {
+		s.Set(c.prefix+name, value)
+		return
+	}
+
+	last, ok := c.last[name]
+	c.last[name] = value
+
+	// the first value is only used as a reference and counters that were reset start over
+	if !ok {
+		return
+	}
+
+	if value < last {
+		last = 0
+	}
+
+	s.Count(c.prefix+name, value-last)
+}
+
+// matchAny returns whether the name matches any of the glob patterns or the fallback when there is none.
+func matchAny(patterns []string, name string, fallback bool) bool {
+	if len(patterns) == 0 {
+		return fallback
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/context"
+)
+
+// Rule transforms the name of a metric.
+// It returns the new name of the metric or false if the metric must be dropped.
+type Rule interface {
+	Apply(name string) (string, bool)
+}
+
+// RuleFunc defines a convenience type to wrap a rule function.
+type RuleFunc func(name string) (string, bool)
+
+// Apply invokes the rule function with the name of the metric.
+func (fn RuleFunc) Apply(name string) (string, bool) {
+	return fn(name)
+}
+
+// Filter applies an ordered list of rules to the name of every metric before passing them on to its reporter.
+// Dropped metrics are not reported as ignored so that they don't fall through to the next writer of a stack.
+type Filter struct {
+	// Reporter receives the metrics that went through every rule.
+	Reporter Reporter
+	// Rules contains the ordered list of rules applied to the names of metrics.
+	Rules []Rule
+}
+
+// NewFilter returns a reporter that applies the rules before writing to the specified reporter.
+func NewFilter(r Reporter, rules ...Rule) Reporter {
+	return &Filter{Reporter: r, Rules: rules}
+}
+
+// NewWriter returns a writer that renames or drops metrics before writing them to the reporter's writer.
+func (filter *Filter) NewWriter(s *Summary) Writer {
+	return &filterWriter{
+		rules:  filter.Rules,
+		Writer: filter.Reporter.NewWriter(s),
+	}
+}
+
+// Stop stops the filtered reporter.
+func (filter *Filter) Stop(c context.Context) error {
+	return Stop(c, filter.Reporter)
+}
+
+type filterWriter struct {
+	Writer
+	rules []Rule
+}
+
+func (w *filterWriter) apply(name string) (string, bool) {
+	for _, rule := range w.rules {
+		var ok bool
+		if name, ok = rule.Apply(name); !ok {
+			return "", false
+		}
+	}
+
+	return name, true
+}
+
+func (w *filterWriter) Write(name string, value float64) error {
+	name, ok := w.apply(name)
+	if !ok {
+		return nil
+	}
+
+	return w.Writer.Write(name, value)
+}
+
+func (w *filterWriter) WriteScaled(name string, value float64) error {
+	name, ok := w.apply(name)
+	if !ok {
+		return nil
+	}
+
+	return w.Writer.WriteScaled(name, value)
+}
+
+func (w *filterWriter) WriteString(name, text string) error {
+	name, ok := w.apply(name)
+	if !ok {
+		return nil
+	}
+
+	return w.Writer.WriteString(name, text)
+}
+
+// match returns true if the name matches any of the glob patterns.
+// Malformed patterns never match.
+func match(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allow keeps only the metrics matching at least one of the glob patterns.
+// Patterns follow the syntax of path.Match where '*' also matches dots.
+func Allow(patterns ...string) Rule {
+	return RuleFunc(func(name string) (string, bool) {
+		return name, match(patterns, name)
+	})
+}
+
+// Deny drops the metrics matching any of the glob patterns.
+// Patterns follow the syntax of path.Match where '*' also matches dots.
+func Deny(patterns ...string) Rule {
+	return RuleFunc(func(name string) (string, bool) {
+		return name, !match(patterns, name)
+	})
+}
+
+// AllowRegexp keeps only the metrics matching the regular expression.
+func AllowRegexp(re *regexp.Regexp) Rule {
+	return RuleFunc(func(name string) (string, bool) {
+		return name, re.MatchString(name)
+	})
+}
+
+// DenyRegexp drops the metrics matching the regular expression.
+func DenyRegexp(re *regexp.Regexp) Rule {
+	return RuleFunc(func(name string) (string, bool) {
+		return name, !re.MatchString(name)
+	})
+}
+
+// Rewrite replaces the matches of the regular expression with the replacement text.
+// Inside the replacement, $1 and ${name} refer to the capture groups as in regexp.Expand.
+func Rewrite(re *regexp.Regexp, replacement string) Rule {
+	return RuleFunc(func(name string) (string, bool) {
+		return re.ReplaceAllString(name, replacement), true
+	})
+}
+
+// Prefix adds a prefix to the name of every metric.
+// A dot is used to separate the prefix from the name when missing.
+func Prefix(prefix string) Rule {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	return RuleFunc(func(name string) (string, bool) {
+		return prefix + name, true
+	})
+}
+
+// Sanitize replaces every character that isn't valid with the replacement text.
+// Metrics that end up with an empty name are dropped.
+func Sanitize(valid func(r rune) bool, replacement string) Rule {
+	return RuleFunc(func(name string) (string, bool) {
+		b := bytes.Buffer{}
+		for _, r := range name {
+			if valid(r) {
+				b.WriteRune(r)
+			} else {
+				b.WriteString(replacement)
+			}
+		}
+
+		return b.String(), b.Len() != 0
+	})
+}
+
+// rewrite returns the name rewritten by the rule e.g. to sanitize names and tags for a protocol.
+func rewrite(rule Rule, name string) string {
+	result, _ := rule.Apply(name)
+	return result
+}
+
+// SanitizeCarbon replaces whitespaces and control characters that would break the Carbon plaintext protocol.
+var SanitizeCarbon = Sanitize(func(r rune) bool {
+	return r < unicode.MaxASCII && unicode.IsPrint(r) && !unicode.IsSpace(r)
+}, "_")
+
+// SanitizePrometheus replaces the characters that are not allowed in Prometheus metric names.
+// Dots are also replaced since Prometheus doesn't support hierarchical names.
+var SanitizePrometheus = Sanitize(func(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':'
+}, "_")
+
+// SanitizePrometheusLabel replaces the characters that are not allowed in Prometheus label names.
+// Unlike metric names, label names can't contain colons.
+var SanitizePrometheusLabel = Sanitize(func(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+}, "_")
+
+// SanitizeOpenTSDB replaces the characters that are not allowed in OpenTSDB metric names and tags.
+var SanitizeOpenTSDB = Sanitize(func(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' || r == '/'
+}, "_")
+
+// SanitizeGraphiteTag replaces the characters that are not allowed in the names and tags of Graphite tagged series.
+var SanitizeGraphiteTag = Sanitize(func(r rune) bool {
+	return r < unicode.MaxASCII && unicode.IsPrint(r) && !unicode.IsSpace(r) && !strings.ContainsRune(";!^=~", r)
+}, "_")
@@ -3,12 +3,16 @@
 package metric
 
 import (
-	"log"
+	"fmt"
 	"time"
 )
 
 // Gauge defines a metric for instantaneous measurements.
 type Gauge struct {
+	// Clock provides the current time used to weight the levels of the gauge.
+	// Will use DefaultClock if nil.
+	Clock Clock
+
 	start time.Time
 	since time.Time
 	sum   float64
@@ -18,20 +22,11 @@ type Gauge struct {
 
 // Record sets the value of the gauge for supported types.
 func (gauge *Gauge) Record(data interface{}) {
-	now := time.Now()
-
-	// account for the value up until now
-	if gauge.valid {
-		gauge.sum += gauge.value * now.Sub(gauge.since).Seconds()
-	} else {
-		gauge.sum = 0
-		gauge.start = now
-	}
-
 	value := 0.0
 	switch item := data.(type) {
 	default:
-		log.Panicf("unknown type %T", data)
+		HandleError(fmt.Errorf("metric: unknown type %T for gauge", data))
+		return
 	case bool:
 		if item {
 			value = 1.0
@@ -46,6 +41,16 @@ func (gauge *Gauge) Record(data interface{}) {
 		value = item.Seconds()
 	}
 
+	now := clockOf(gauge.Clock).Now()
+
+	// account for the value up until now
+	if gauge.valid {
+		gauge.sum += gauge.value * now.Sub(gauge.since).Seconds()
+	} else {
+		gauge.sum = 0
+		gauge.start = now
+	}
+
 	gauge.value = value
 	gauge.since = now
 	gauge.valid = true
@@ -53,7 +58,7 @@ func (gauge *Gauge) Record(data interface{}) {
 
 // Reset keeps the current level of the gauge but reset the partial sum.
 func (gauge *Gauge) Reset() {
-	now := time.Now()
+	now := clockOf(gauge.Clock).Now()
 	gauge.sum = 0
 	gauge.start = now
 	gauge.since = now
@@ -65,7 +70,7 @@ func (gauge *Gauge) Write(w Writer, name string) {
 		return
 	}
 
-	now := time.Now()
+	now := clockOf(gauge.Clock).Now()
 	total := gauge.sum + gauge.value*now.Sub(gauge.since).Seconds()
 	value := total / now.Sub(gauge.start).Seconds()
 	w.Write(name, value)
@@ -3,7 +3,7 @@
 package metric
 
 import (
-	"log"
+	"fmt"
 	"math"
 	"math/rand"
 	"sort"
@@ -25,12 +25,33 @@ type Histogram struct {
 	valid   bool
 }
 
+// NewHistogram returns an histogram that tracks the specified percentiles.
+// It returns an error if a percentile is not within 0 and 100.
+func NewHistogram(percentiles map[string]float64) (*Histogram, error) {
+	for id, value := range percentiles {
+		if err := checkPercentile(id, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Histogram{Percentiles: percentiles}, nil
+}
+
+func checkPercentile(id string, value float64) error {
+	if value < 0.0 || value > 100.0 {
+		return fmt.Errorf("metric: invalid percentile '%s=%f'", id, value)
+	}
+
+	return nil
+}
+
 // Record adds a sample to the stream of values for supported types.
 func (histogram *Histogram) Record(data interface{}) {
 	value := 0.0
 	switch item := data.(type) {
 	default:
-		log.Panicf("unknown type %T", data)
+		HandleError(fmt.Errorf("metric: unknown type %T for histogram", data))
+		return
 	case int:
 		value = float64(item)
 	case int64:
@@ -92,7 +113,12 @@ func (histogram *Histogram) Write(w Writer, name string) {
 
 	k := float64(histogram.count)
 	percentile := func(n float64) float64 {
-		return histogram.items[int(k*n)]
+		i := int(k * n)
+		if i >= histogram.count {
+			i = histogram.count - 1
+		}
+
+		return histogram.items[i]
 	}
 
 	path := name + "."
@@ -105,8 +131,9 @@ func (histogram *Histogram) Write(w Writer, name string) {
 		w.Write(path+"99th", percentile(0.99))
 	} else {
 		for id, value := range histogram.Percentiles {
-			if value < 0.0 || value > 1.0 {
-				log.Fatalf("metric: invalid percentile '%s=%f' for histogram '%s'\n", id, value, name)
+			if err := checkPercentile(id, value); err != nil {
+				HandleError(fmt.Errorf("%s for histogram '%s'", err, name))
+				continue
 			}
 
 			w.Write(path+id, percentile(value/100.0))
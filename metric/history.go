@@ -0,0 +1,312 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Point contains the value of a key at a point in time.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// History keeps the last periods of every key in memory e.g. to look at the recent metrics of the process itself.
+// Values of every key are kept in a ring buffer at the resolution of the summary and optionally downsampled to coarser resolutions.
+// Rates are scaled by the period like Carbon does and strings are ignored.
+// Keys are removed once their newest point is older than the time covered by the coarsest resolution.
+//
+// History also serves the points as JSON over HTTP.
+// The 'match' parameter selects keys with a glob pattern, 'from' and 'to' select the time range and 'step' selects the resolution.
+// Times are in RFC 3339 format, in seconds since the epoch or a duration before now e.g. 'from=1h'. The last hour is returned by default.
+type History struct {
+	// Periods contains the number of points kept at every resolution. Will use 360 if 0.
+	Periods int
+	// Resolutions is optional and contains coarser resolutions where points are averaged e.g. {time.Minute, time.Hour}.
+	Resolutions []time.Duration
+	// Clock provides the current time used by the default time ranges of HTTP queries.
+	// Will use DefaultClock if nil.
+	Clock Clock
+
+	once   sync.Once
+	mu     sync.RWMutex
+	series map[string]*historySeries
+}
+
+type historySeries struct {
+	levels []*historyRing
+	// last contains the time of the newest point.
+	last int64
+}
+
+// historyRing contains the points of a key at one resolution.
+// Coarser resolutions accumulate the values of the current bucket until the next one starts.
+type historyRing struct {
+	step   time.Duration
+	times  []int64
+	values []float64
+	next   int
+	count  int
+	bucket int64
+	sum    float64
+	n      int
+}
+
+// NewWriter returns a writer that adds the metrics of the summary to the history when it is closed.
+func (h *History) NewWriter(s *Summary) Writer {
+	h.once.Do(h.initialize)
+
+	return &historyWriter{
+		h:      h,
+		time:   s.Time,
+		step:   s.Step,
+		dt:     s.Step.Seconds(),
+		values: make(map[string]float64),
+	}
+}
+
+func (h *History) initialize() {
+	if h.Periods == 0 {
+		h.Periods = 360
+	}
+
+	h.series = make(map[string]*historySeries)
+}
+
+func (h *History) add(t time.Time, step time.Duration, values map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ns := t.UnixNano()
+	defer h.evict(ns, step)
+
+	for name, value := range values {
+		s, ok := h.series[name]
+		if !ok {
+			s = &historySeries{
+				levels: make([]*historyRing, len(h.Resolutions)+1),
+			}
+
+			s.levels[0] = newHistoryRing(0, h.Periods)
+			for i, step := range h.Resolutions {
+				s.levels[i+1] = newHistoryRing(step, h.Periods)
+			}
+
+			h.series[name] = s
+		}
+
+		s.last = ns
+		for _, ring := range s.levels {
+			ring.add(ns, value)
+		}
+	}
+}
+
+// evict removes the keys whose newest point is older than the retention of the coarsest resolution.
+func (h *History) evict(ns int64, step time.Duration) {
+	for _, resolution := range h.Resolutions {
+		if resolution > step {
+			step = resolution
+		}
+	}
+
+	if step <= 0 {
+		return
+	}
+
+	oldest := ns - int64(h.Periods)*int64(step)
+	for name, s := range h.series {
+		if s.last < oldest {
+			delete(h.series, name)
+		}
+	}
+}
+
+func newHistoryRing(step time.Duration, n int) *historyRing {
+	return &historyRing{
+		step:   step,
+		times:  make([]int64, n),
+		values: make([]float64, n),
+	}
+}
+
+func (ring *historyRing) add(ns int64, value float64) {
+	if ring.step == 0 {
+		ring.push(ns, value)
+		return
+	}
+
+	bucket := ns - ns%int64(ring.step)
+	if ring.n != 0 && bucket != ring.bucket {
+		ring.push(ring.bucket, ring.sum/float64(ring.n))
+		ring.sum, ring.n = 0, 0
+	}
+
+	ring.bucket = bucket
+	ring.sum += value
+	ring.n++
+}
+
+func (ring *historyRing) push(ns int64, value float64) {
+	ring.times[ring.next] = ns
+	ring.values[ring.next] = value
+	ring.next = (ring.next + 1) % len(ring.times)
+	if ring.count < len(ring.times) {
+		ring.count++
+	}
+}
+
+// points returns the points within the time range in order.
+func (ring *historyRing) points(from, to int64) (result []Point) {
+	n := len(ring.times)
+	for i := 0; i < ring.count; i++ {
+		k := (ring.next - ring.count + i + n) % n
+		if t := ring.times[k]; t >= from && t <= to {
+			result = append(result, Point{Time: time.Unix(0, t).UTC(), Value: ring.values[k]})
+		}
+	}
+
+	return
+}
+
+// Keys returns the keys of the history in order.
+func (h *History) Keys() []string {
+	h.once.Do(h.initialize)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Query returns the points of the keys matching the glob pattern within the time range.
+// Points come from the coarsest resolution that is not coarser than the specified step.
+// Points of a coarser resolution only appear once their bucket is complete.
+func (h *History) Query(pattern string, from, to time.Time, step time.Duration) map[string][]Point {
+	h.once.Do(h.initialize)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	level := 0
+	for i, resolution := range h.Resolutions {
+		if resolution <= step && (level == 0 || resolution > h.Resolutions[level-1]) {
+			level = i + 1
+		}
+	}
+
+	result := make(map[string][]Point)
+	for key, s := range h.series {
+		if ok, _ := path.Match(pattern, key); !ok {
+			continue
+		}
+
+		if points := s.levels[level].points(from.UnixNano(), to.UnixNano()); len(points) != 0 {
+			result[key] = points
+		}
+	}
+
+	return result
+}
+
+// ServeHTTP returns the points selected by the query parameters as a JSON object of keys to points.
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := clockOf(h.Clock).Now()
+
+	pattern := query.Get("match")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	from, err := parseHistoryTime(query.Get("from"), now, now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to, err := parseHistoryTime(query.Get("to"), now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var step time.Duration
+	if text := query.Get("step"); text != "" {
+		if step, err = time.ParseDuration(text); err != nil {
+			http.Error(w, fmt.Sprintf("invalid step '%s'", text), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Query(pattern, from, to, step)); err != nil {
+		HandleError(fmt.Errorf("history: %s", err))
+	}
+}
+
+// parseHistoryTime parses a time in RFC 3339 format, in seconds since the epoch or as a duration before now.
+func parseHistoryTime(text string, now, fallback time.Time) (time.Time, error) {
+	if text == "" {
+		return fallback, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return t, nil
+	}
+
+	if seconds, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	if d, err := time.ParseDuration(text); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time '%s'", text)
+}
+
+type historyWriter struct {
+	h      *History
+	time   time.Time
+	step   time.Duration
+	dt     float64
+	values map[string]float64
+}
+
+// Write rejects values that can't be averaged or encoded in JSON.
+func (w *historyWriter) Write(name string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("history: invalid value %f for '%s'", value, name)
+	}
+
+	w.values[name] = value
+	return nil
+}
+
+func (w *historyWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *historyWriter) WriteString(name, text string) error {
+	return ErrIgnored
+}
+
+func (w *historyWriter) Close() {
+	w.h.add(w.time, w.step, w.values)
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	"golang.org/x/net/context"
+)
+
+// Influx enables writing summary of metrics to InfluxDB using the line protocol.
+// Keys are split on their last dot into a measurement and a field e.g. 'Request.Latency.99th' becomes the field '99th' of the measurement 'Request.Latency'.
+// Keys without a dot are written to the 'value' field.
+// Points are sent in order by a background worker over HTTP or UDP and every failure is passed on to HandleError.
+// HTTP requests are retried on network errors, throttling or server errors.
+type Influx struct {
+	// URL contains the address of the server. The scheme selects the transport e.g.
+	// http://127.0.0.1:8086/write?db=metrics for the 1.x API,
+	// http://127.0.0.1:8086/api/v2/write?org=datacratic&bucket=metrics for the 2.x API or
+	// udp://127.0.0.1:8089.
+	URL string
+	// Prefix contains the path under which all measurements will be written.
+	Prefix string
+	// Tags contains tags added to every point e.g. the host name.
+	Tags map[string]string
+	// Precision contains the unit of timestamps which can be 's', 'ms', 'us' or 'ns'. Will use 's' if empty or invalid.
+	Precision string
+	// Token is optional and contains the authentication token sent with HTTP requests.
+	Token string
+	// Client is optional and contains the HTTP client used to send points.
+	Client *http.Client
+	// Timeout contains the time limit of every request when no client is specified. Will use 10s if 0.
+	Timeout time.Duration
+	// Gzip compresses the body of HTTP requests.
+	Gzip bool
+	// BatchSize contains the maximum number of lines per HTTP request. Will use 5000 if 0.
+	BatchSize int
+	// PacketSize contains the maximum number of bytes per UDP datagram. Will use 1024 if 0.
+	// Lines are never split so a single larger line is sent in its own datagram.
+	PacketSize int
+	// Retries contains the number of attempts made to send a batch over HTTP before dropping it. Will use 3 if 0.
+	Retries int
+	// Backoff contains the delay before the first retry and doubles after every attempt up to a minute. Will use 1s if 0.
+	Backoff time.Duration
+	// Backlog contains the number of summaries waiting to be sent. Will use 16 if 0.
+	// When the backlog is full, the summary is dropped.
+	Backlog int
+
+	once   sync.Once
+	busy   deliveries
+	feed   chan []string
+	quit   chan struct{}
+	path   string
+	tags   string
+	target string
+	conn   net.Conn
+}
+
+// NewInflux returns a reporter that writes metrics under the prefix to the InfluxDB server at the specified URL.
+// It returns an error if the URL is invalid or uses an unsupported transport.
+func NewInflux(prefix, address string) (*Influx, error) {
+	if _, err := parseInfluxAddress(address); err != nil {
+		return nil, err
+	}
+
+	return &Influx{URL: address, Prefix: prefix}, nil
+}
+
+// parseInfluxAddress validates an URL like http://127.0.0.1:8086/write?db=metrics or udp://127.0.0.1:8089.
+func parseInfluxAddress(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("influx: invalid url '%s': %s", address, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "udp":
+	default:
+		return nil, fmt.Errorf("influx: invalid url '%s': unsupported transport '%s'", address, u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("influx: invalid url '%s': missing address", address)
+	}
+
+	return u, nil
+}
+
+// NewWriter creates a new writer that groups the metrics of the summary into points.
+// Points are sent when the writer is closed.
+func (influx *Influx) NewWriter(s *Summary) Writer {
+	influx.once.Do(influx.initialize)
+
+	return &influxWriter{
+		influx: influx,
+		dt:     s.Step.Seconds(),
+		time:   influxTime(s.Time.UnixNano(), influx.Precision),
+		fields: make(map[string][]string),
+	}
+}
+
+func (influx *Influx) initialize() {
+	influx.Precision = defaults.String(influx.Precision, "s")
+	switch influx.Precision {
+	case "s", "ms", "us", "ns":
+	default:
+		HandleError(fmt.Errorf("influx: invalid precision '%s', using seconds", influx.Precision))
+		influx.Precision = "s"
+	}
+
+	influx.Backoff = defaults.Duration(influx.Backoff, time.Second)
+
+	if influx.Client == nil {
+		influx.Client = &http.Client{
+			Timeout: defaults.Duration(influx.Timeout, 10*time.Second),
+		}
+	}
+
+	if influx.BatchSize == 0 {
+		influx.BatchSize = 5000
+	}
+
+	if influx.Retries == 0 {
+		influx.Retries = 3
+	}
+
+	if influx.Backlog == 0 {
+		influx.Backlog = 16
+	}
+
+	influx.feed = make(chan []string, influx.Backlog)
+	influx.quit = make(chan struct{})
+	go influx.run()
+
+	if influx.PacketSize == 0 {
+		influx.PacketSize = 1024
+	}
+
+	influx.path = influx.Prefix
+	if influx.path != "" && !strings.HasSuffix(influx.path, ".") {
+		influx.path += "."
+	}
+
+	// tags are sorted as recommended for the best performance of the server
+	for _, key := range sortedTags(influx.Tags) {
+		influx.tags += "," + influxEscape(key, ",= ") + "=" + influxEscape(influx.Tags[key], ",= ")
+	}
+
+	u, err := parseInfluxAddress(influx.URL)
+	if err != nil {
+		HandleError(err)
+		return
+	}
+
+	if u.Scheme == "udp" {
+		if influx.conn, err = net.Dial("udp", u.Host); err != nil {
+			HandleError(fmt.Errorf("influx: %s", err))
+		}
+
+		return
+	}
+
+	// the precision is named differently by the 1.x API
+	precision := influx.Precision
+	if precision == "us" && !strings.HasSuffix(u.Path, "/api/v2/write") {
+		precision = "u"
+	}
+
+	query := u.Query()
+	query.Set("precision", precision)
+	u.RawQuery = query.Encode()
+	influx.target = u.String()
+}
+
+// Stop waits for the pending points to be sent or the context to be done.
+// When the context is done first, the remaining retries are aborted.
+// Points written afterwards are dropped and stopping again returns ErrStopped.
+func (influx *Influx) Stop(c context.Context) error {
+	influx.once.Do(influx.initialize)
+
+	err := influx.busy.stop(c)
+	if err != ErrStopped {
+		close(influx.quit)
+	}
+
+	return err
+}
+
+// run sends the queued summaries until the reporter is stopped.
+func (influx *Influx) run() {
+	for {
+		select {
+		case lines := <-influx.feed:
+			influx.send(lines)
+			influx.busy.done()
+		case <-influx.quit:
+			if influx.conn != nil {
+				influx.conn.Close()
+			}
+
+			return
+		}
+	}
+}
+
+// send delivers the lines in batches.
+func (influx *Influx) send(lines []string) {
+	if influx.conn != nil {
+		influx.sendPackets(lines)
+		return
+	}
+
+	if influx.target == "" {
+		return
+	}
+
+	for i := 0; i < len(lines); i += influx.BatchSize {
+		j := i + influx.BatchSize
+		if j > len(lines) {
+			j = len(lines)
+		}
+
+		body := strings.Join(lines[i:j], "")
+		backoff := Backoff{Delay: influx.Backoff, Attempts: influx.Retries}
+		err := backoff.Retry(influx.quit, func(attempt int) (bool, error) {
+			retry, err := influx.post(body)
+			if err != nil {
+				HandleError(fmt.Errorf("influx: %s", err))
+				Self.Count("Influx.Errors", 1)
+			}
+
+			return retry, err
+		})
+
+		if err != nil {
+			HandleError(fmt.Errorf("influx: dropping %d lines for '%s'", j-i, influx.URL))
+			Self.Count("Influx.Dropped", float64(j-i))
+			continue
+		}
+
+		Self.Count("Influx.Bytes", float64(len(body)))
+		Self.Count("Influx.Lines", float64(j-i))
+	}
+}
+
+func (influx *Influx) sendPackets(lines []string) {
+	var packet bytes.Buffer
+
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+
+		if _, err := influx.conn.Write(packet.Bytes()); err != nil {
+			HandleError(fmt.Errorf("influx: %s", err))
+			Self.Count("Influx.Errors", 1)
+		} else {
+			Self.Count("Influx.Bytes", float64(packet.Len()))
+		}
+
+		packet.Reset()
+	}
+
+	for _, line := range lines {
+		if packet.Len()+len(line) > influx.PacketSize {
+			flush()
+		}
+
+		packet.WriteString(line)
+		Self.Count("Influx.Lines", 1)
+	}
+
+	flush()
+}
+
+// post sends the lines once and returns whether a failure can be retried.
+func (influx *Influx) post(text string) (retry bool, err error) {
+	body := &bytes.Buffer{}
+	if influx.Gzip {
+		w := gzip.NewWriter(body)
+		if _, err = io.WriteString(w, text); err != nil {
+			return
+		}
+
+		if err = w.Close(); err != nil {
+			return
+		}
+	} else {
+		body.WriteString(text)
+	}
+
+	req, err := http.NewRequest("POST", influx.target, body)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if influx.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if influx.Token != "" {
+		req.Header.Set("Authorization", "Token "+influx.Token)
+	}
+
+	r, err := influx.Client.Do(req)
+	if err != nil {
+		retry = true
+		return
+	}
+
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		retry = true
+		return
+	}
+
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		retry = r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+		err = fmt.Errorf("unexpected status '%s' from '%s': %s", r.Status, influx.URL, bytes.TrimSpace(data))
+	}
+
+	return
+}
+
+type influxWriter struct {
+	influx *Influx
+	dt     float64
+	time   string
+	names  []string
+	fields map[string][]string
+}
+
+func (w *influxWriter) Write(name string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("influx: invalid value %f for '%s'", value, name)
+	}
+
+	measurement, field := name, "value"
+	if i := strings.LastIndex(name, "."); i != -1 {
+		measurement, field = name[:i], name[i+1:]
+	}
+
+	if _, ok := w.fields[measurement]; !ok {
+		w.names = append(w.names, measurement)
+	}
+
+	text := influxEscape(field, ",= ") + "=" + strconv.FormatFloat(value, 'f', -1, 64)
+	w.fields[measurement] = append(w.fields[measurement], text)
+	return nil
+}
+
+func (w *influxWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *influxWriter) WriteString(name, text string) error {
+	return ErrIgnored
+}
+
+func (w *influxWriter) Close() {
+	if len(w.names) == 0 {
+		return
+	}
+
+	lines := make([]string, 0, len(w.names))
+	for _, name := range w.names {
+		measurement := influxEscape(w.influx.path+name, ", ")
+		fields := strings.Join(w.fields[name], ",")
+		lines = append(lines, measurement+w.influx.tags+" "+fields+" "+w.time+"\n")
+	}
+
+	if !w.influx.busy.add() {
+		HandleError(fmt.Errorf("influx: dropping %d points: %s", len(lines), ErrStopped))
+		return
+	}
+
+	select {
+	case w.influx.feed <- lines:
+	default:
+		w.influx.busy.done()
+		HandleError(fmt.Errorf("influx: backlog is full, dropping %d points", len(lines)))
+		Self.Count("Influx.Dropped", float64(len(lines)))
+	}
+}
+
+// influxEscape adds a backslash before the special characters of the line protocol.
+func influxEscape(text, special string) string {
+	if !strings.ContainsAny(text, special) {
+		return text
+	}
+
+	var b bytes.Buffer
+	for _, c := range text {
+		if strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// influxTime formats a timestamp in nanoseconds with the specified precision.
+func influxTime(ns int64, precision string) string {
+	switch precision {
+	case "ms":
+		ns /= 1e6
+	case "us", "u":
+		ns /= 1e3
+	case "ns":
+	default:
+		ns /= 1e9
+	}
+
+	return strconv.FormatInt(ns, 10)
+}
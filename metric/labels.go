@@ -3,8 +3,8 @@
 package metric
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"strings"
 )
 
@@ -28,7 +28,7 @@ func (labels *Labels) Record(value interface{}) {
 	}
 
 	if text == "" {
-		log.Printf("cannot record an empty string")
+		HandleError(errors.New("metric: cannot record an empty string"))
 		return
 	}
 
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import "strings"
+
+// OverflowKey contains the name of the bucket that receives the records of keys past the cardinality limits.
+// Records are redirected to a key of the same kind e.g. 'app.__overflow__.Count'.
+// The number of distinct keys redirected during the period is counted in the '__overflow__.Rejected' key.
+const OverflowKey = "__overflow__"
+
+// admit returns the key that should be created for the specified name according to the cardinality limits.
+func (summary *Summary) admit(name string, item Metric) string {
+	if strings.Contains(name, OverflowKey) {
+		return name
+	}
+
+	// the longest prefix wins when limits overlap
+	prefix, ok := "", summary.MaxKeys != 0 && summary.count >= summary.MaxKeys
+	if !ok {
+		for p, n := range summary.Limits {
+			if strings.HasPrefix(name, p) && summary.counts[p] >= n && (!ok || len(p) > len(prefix)) {
+				prefix, ok = p, true
+			}
+		}
+	}
+
+	if !ok {
+		return name
+	}
+
+	if !summary.rejected[name] {
+		if summary.rejected == nil {
+			summary.rejected = make(map[string]bool)
+		}
+
+		summary.rejected[name] = true
+		summary.Count(OverflowKey+".Rejected", 1)
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	return prefix + OverflowKey + "." + kindOf(item)
+}
+
+// track updates the number of keys subject to the cardinality limits.
+func (summary *Summary) track(name string, delta int) {
+	if strings.Contains(name, OverflowKey) {
+		return
+	}
+
+	summary.count += delta
+
+	for p := range summary.Limits {
+		if strings.HasPrefix(name, p) {
+			if summary.counts == nil {
+				summary.counts = make(map[string]int)
+			}
+
+			summary.counts[p] += delta
+		}
+	}
+}
+
+func kindOf(item Metric) string {
+	switch item.(type) {
+	case *Counter:
+		return "Count"
+	case *Gauge:
+		return "Set"
+	case *Histogram:
+		return "Record"
+	case *Labels:
+		return "Log"
+	}
+
+	return "Metric"
+}
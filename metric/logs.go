@@ -4,6 +4,7 @@ package metric
 
 import (
 	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -25,6 +26,26 @@ type Logs struct {
 	once   sync.Once
 }
 
+// NewLogs returns a reporter that writes a log line for each metric in the specified file.
+// It returns an error if the log file can't be created.
+func NewLogs(filename, prefix string) (*Logs, error) {
+	logs := &Logs{
+		Filename: filename,
+		Prefix:   prefix,
+	}
+
+	var err error
+	logs.once.Do(func() {
+		err = logs.open()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return logs, nil
+}
+
 // NewWriter returns a writer that will writes all metrics to its logger.
 func (logs *Logs) NewWriter(s *Summary) Writer {
 	logs.once.Do(logs.initialize)
@@ -34,7 +55,16 @@ func (logs *Logs) NewWriter(s *Summary) Writer {
 	}
 }
 
+// initialize falls back to stderr when the log file can't be created.
 func (logs *Logs) initialize() {
+	if err := logs.open(); err != nil {
+		HandleError(err)
+		logs.Filename = ""
+		logs.open()
+	}
+}
+
+func (logs *Logs) open() error {
 	fd := os.Stderr
 
 	path := logs.Filename
@@ -44,12 +74,13 @@ func (logs *Logs) initialize() {
 		var err error
 		fd, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
 		if err != nil {
-			log.Fatalf("failed to create log file '%s': %s\n", path, err)
+			return fmt.Errorf("logs: failed to create log file '%s': %s", path, err)
 		}
 	}
 
 	logs.writer = bufio.NewWriter(fd)
 	logs.logger = log.New(logs.writer, logs.Prefix, log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	return nil
 }
 
 type logWriter struct {
@@ -3,8 +3,29 @@
 package metric
 
 import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestMetrics(t *testing.T) {
@@ -30,3 +51,1210 @@ func TestMetrics(t *testing.T) {
 
 	s.Write(&Logs{})
 }
+
+// memory records every metric written in a map for inspection.
+type memory struct {
+	mu     sync.Mutex
+	values map[string]float64
+	opened int
+	closed int
+}
+
+func (m *memory) NewWriter(s *Summary) Writer {
+	m.mu.Lock()
+	m.opened++
+	m.mu.Unlock()
+
+	return &memoryWriter{m: m, dt: s.Step.Seconds()}
+}
+
+type memoryWriter struct {
+	m  *memory
+	dt float64
+}
+
+func (w *memoryWriter) Write(name string, value float64) error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+
+	if w.m.values == nil {
+		w.m.values = make(map[string]float64)
+	}
+
+	w.m.values[name] = value
+	return nil
+}
+
+func (w *memoryWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *memoryWriter) WriteString(name, text string) error {
+	return ErrIgnored
+}
+
+func (w *memoryWriter) Close() {
+	w.m.mu.Lock()
+	w.m.closed++
+	w.m.mu.Unlock()
+}
+
+// gated holds the writers of the memory on close until the gate is opened.
+type gated struct {
+	*memory
+	gate chan struct{}
+}
+
+func (g *gated) NewWriter(s *Summary) Writer {
+	return &gatedWriter{Writer: g.memory.NewWriter(s), gate: g.gate}
+}
+
+type gatedWriter struct {
+	Writer
+	gate chan struct{}
+}
+
+func (w *gatedWriter) Close() {
+	<-w.gate
+	w.Writer.Close()
+}
+
+func TestTee(t *testing.T) {
+	a, b := &memory{}, &memory{}
+
+	s := &Summary{
+		Step: time.Second,
+	}
+
+	s.Count("c", 2)
+	s.Write(NewTee(a, b))
+
+	for i, m := range []*memory{a, b} {
+		if m.values["c"] != 2 || m.closed != 1 {
+			t.Fatalf("reporter %d received %v and was closed %d times", i, m.values, m.closed)
+		}
+	}
+
+	c := &memory{}
+	tee := &Tee{Items: []Reporter{c}, Async: true}
+	s.Write(tee)
+
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+
+		if closed == 1 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	c.mu.Lock()
+	if c.values["c"] != 2 || c.closed != 1 {
+		t.Fatalf("asynchronous reporter received %v and was closed %d times", c.values, c.closed)
+	}
+
+	c.mu.Unlock()
+
+	var errors []error
+	SetErrorHandler(func(err error) {
+		errors = append(errors, err)
+	})
+
+	defer SetErrorHandler(nil)
+
+	if err := tee.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tee.Stop(context.Background()); err != ErrStopped {
+		t.Fatalf("expecting a second stop to fail instead of %v", err)
+	}
+
+	s.Write(tee)
+	if len(errors) != 1 || !strings.HasSuffix(errors[0].Error(), ErrStopped.Error()) {
+		t.Fatalf("expecting summaries written after stop to be dropped instead of %v", errors)
+	}
+
+	// the first summary is being delivered, the second is queued and the third is dropped
+	g := &gated{memory: &memory{}, gate: make(chan struct{})}
+	tee = &Tee{Items: []Reporter{g}, Async: true, Backlog: 1}
+	s.Write(tee)
+
+	for opened := 0; opened == 0; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		opened = g.opened
+		g.mu.Unlock()
+	}
+
+	s.Write(tee)
+	s.Write(tee)
+	close(g.gate)
+
+	if err := tee.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.opened != 2 || g.closed != 2 {
+		t.Fatalf("expecting the writers of 2 summaries to be closed instead of %d opened and %d closed", g.opened, g.closed)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	m := &memory{}
+
+	s := &Summary{
+		Step: time.Second,
+	}
+
+	s.Set("host 1.cpu", 1)
+	s.Set("host 1.mem", 2)
+	s.Set("debug.x", 3)
+	s.Set("request.abc123.latency", 4)
+
+	s.Write(NewFilter(m,
+		Deny("debug.*"),
+		Rewrite(regexp.MustCompile(`^request\.[a-z]+[0-9]+\.`), "request.id."),
+		Prefix("app"),
+		SanitizeCarbon,
+	))
+
+	expected := map[string]float64{
+		"app.host_1.cpu":         1,
+		"app.host_1.mem":         2,
+		"app.request.id.latency": 4,
+	}
+
+	if len(m.values) != len(expected) {
+		t.Fatalf("expecting %v instead of %v", expected, m.values)
+	}
+
+	for name, value := range expected {
+		if m.values[name] != value {
+			t.Fatalf("expecting %v instead of %v", expected, m.values)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s := &Summary{
+		Step:    time.Second,
+		MaxKeys: 3,
+		Limits: map[string]int{
+			"user.":       1,
+			"user.admin.": 1,
+		},
+	}
+
+	s.Count("a", 1)
+	s.Count("user.admin.1", 1)
+	s.Count("user.1", 1)
+	s.Count("user.2", 1)
+	s.Count("user.2", 1)
+	s.Count("user.admin.2", 1)
+	s.Count("b", 1)
+	s.Count("c", 1)
+	s.Record("d", 1)
+
+	m := &memory{}
+	s.Write(m)
+
+	expected := map[string]float64{
+		"a":                             1,
+		"b":                             1,
+		"user.admin.1":                  1,
+		"user.__overflow__.Count":       3,
+		"user.admin.__overflow__.Count": 1,
+		"__overflow__.Count":            1,
+		"__overflow__.Rejected":         5,
+		"__overflow__.Record.Minimum":   1,
+	}
+
+	for name, value := range expected {
+		if m.values[name] != value {
+			t.Fatalf("expecting %s=%f in %v", name, value, m.values)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := &Summary{
+		Step:   time.Second,
+		Expiry: 1,
+	}
+
+	s.Count("c", 1)
+	s.Set("g", 1)
+	s.Reset()
+
+	s.Count("d", 1)
+	s.Reset()
+
+	if _, ok := s.Keys["c"]; ok {
+		t.Fatalf("stale counter should have been removed")
+	}
+
+	if _, ok := s.Keys["g"]; !ok {
+		t.Fatalf("gauge should be kept by default")
+	}
+
+	if _, ok := s.Keys["d"]; !ok {
+		t.Fatalf("counter recorded during the last period should be kept")
+	}
+
+	s.ExpireGauges = true
+	s.Reset()
+
+	if _, ok := s.Keys["g"]; ok {
+		t.Fatalf("stale gauge should have been removed")
+	}
+}
+
+func TestGauge(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+
+	s := &Summary{
+		Step:  4 * time.Second,
+		Clock: clock,
+	}
+
+	s.Set("g", 1)
+	clock.Advance(time.Second)
+	s.Set("g", 5)
+	clock.Advance(3 * time.Second)
+
+	m := &memory{}
+	s.Write(m)
+
+	if m.values["g"] != 4 {
+		t.Fatalf("expecting a time-weighted average of 4 instead of %f", m.values["g"])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var errors []error
+	SetErrorHandler(func(err error) {
+		errors = append(errors, err)
+	})
+
+	defer SetErrorHandler(nil)
+
+	n := ErrorCount()
+
+	s := &Summary{}
+	s.Count("c", "text")
+	s.Set("g", "text")
+	s.Record("h", "text")
+
+	if len(errors) != 3 || ErrorCount()-n != 3 {
+		t.Fatalf("expecting 3 errors instead of %v", errors)
+	}
+
+	if _, err := NewHistogram(map[string]float64{"101th": 101}); err == nil {
+		t.Fatalf("expecting an invalid percentile")
+	}
+
+	if _, err := NewCarbon("", "127.0.0.1:2003"); err == nil {
+		t.Fatalf("expecting an invalid url")
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+
+	s := &Summary{
+		Step:  time.Second,
+		Clock: clock,
+	}
+
+	Self.Count("Test.Count", 2)
+	Self.Set("Test.Level", 3)
+	Self.Counter("Test.Atomic").Add(4)
+	Self.Record(s)
+	clock.Advance(time.Second)
+
+	m := &memory{}
+	s.Write(m)
+
+	if m.values["gometrics.Test.Count"] != 2 || m.values["gometrics.Test.Level"] != 3 || m.values["gometrics.Test.Atomic"] != 4 {
+		t.Fatalf("expecting the telemetry in the summary instead of %v", m.values)
+	}
+
+	s.Reset()
+	Self.Record(s)
+	clock.Advance(time.Second)
+
+	m = &memory{}
+	s.Write(m)
+
+	if m.values["gometrics.Test.Count"] != 0 {
+		t.Fatalf("expecting the counters to be consumed instead of %f", m.values["gometrics.Test.Count"])
+	}
+
+	// the fake clock doesn't move while reporting
+	if d, ok := m.values["gometrics.Reporter.memory.Duration"]; !ok || d != 0 {
+		t.Fatalf("expecting the duration of the report instead of %v", m.values)
+	}
+}
+
+func TestInflux(t *testing.T) {
+	lines := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("precision") != "ms" {
+			t.Errorf("expecting a precision of 'ms' instead of '%s'", r.URL.RawQuery)
+		}
+
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		lines <- string(data)
+	}))
+
+	defer server.Close()
+
+	influx := &Influx{
+		URL:       server.URL + "/write?db=test",
+		Prefix:    "app",
+		Tags:      map[string]string{"host": "a b"},
+		Precision: "ms",
+		Gzip:      true,
+	}
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: time.Second,
+	}
+
+	s.Count("c", 2)
+	s.Record("h", 1)
+	s.Write(influx)
+
+	if err := influx.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	result := strings.Split(strings.TrimSpace(<-lines), "\n")
+	sort.Strings(result)
+
+	expected := []string{
+		"app.c,host=a\\ b value=2 10000",
+		"app.h,host=a\\ b Minimum=1,Maximum=1,50th=1,90th=1,99th=1 10000",
+	}
+
+	if len(result) != 2 || result[0] != expected[0] || result[1] != expected[1] {
+		t.Fatalf("expecting lines %q instead of %q", expected, result)
+	}
+	// summaries are dropped while the worker is busy and the backlog is full
+	var mu sync.Mutex
+	var errors []string
+	SetErrorHandler(func(err error) {
+		mu.Lock()
+		errors = append(errors, err.Error())
+		mu.Unlock()
+	})
+
+	defer SetErrorHandler(nil)
+
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	defer slow.Close()
+
+	influx = &Influx{
+		URL:     slow.URL + "/write?db=test",
+		Backlog: 1,
+	}
+
+	for i := 0; i < 3; i++ {
+		s.Write(influx)
+	}
+
+	close(block)
+
+	if err := influx.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(errors) == 0 || !strings.Contains(errors[0], "backlog is full") {
+		t.Fatalf("expecting a summary to be dropped instead of %v", errors)
+	}
+}
+
+func TestInfluxUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	influx, err := NewInflux("", "udp://"+conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errors []error
+	SetErrorHandler(func(err error) {
+		errors = append(errors, err)
+	})
+
+	defer SetErrorHandler(nil)
+
+	// minutes aren't supported by every version of the server
+	influx.Precision = "m"
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: time.Second,
+	}
+
+	s.Count("Requests.Count", 3)
+	s.Write(influx)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text := string(data[:n]); text != "Requests Count=3 10\n" {
+		t.Fatalf("unexpected datagram %q", text)
+	}
+
+	if len(errors) != 1 || !strings.Contains(errors[0].Error(), "invalid precision") {
+		t.Fatalf("expecting the precision to be rejected instead of %v", errors)
+	}
+
+	influx.Stop(context.Background())
+}
+
+func TestOpenTSDB(t *testing.T) {
+	tagger := &Tagger{
+		Tags:      map[string]string{"env": "test"},
+		Positions: map[string]int{"host": 1, "quantile": -1},
+	}
+
+	name, tags := tagger.Split("app.web1.Latency.99th")
+	if name != "app.Latency" || tags["host"] != "web1" || tags["quantile"] != "99th" || tags["env"] != "test" {
+		t.Fatalf("unexpected split '%s' with %v", name, tags)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		data, _ := ioutil.ReadAll(conn)
+		lines <- string(data)
+	}()
+
+	tsdb, err := NewOpenTSDB("app", "tcp://"+l.Addr().String(), map[string]string{"host": "web 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: 2 * time.Second,
+	}
+
+	s.Count("Requests", 4)
+	s.Write(tsdb)
+
+	if err := tsdb.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if text := <-lines; text != "put app.Requests 10 2 host=web_1\n" {
+		t.Fatalf("unexpected lines %q", text)
+	}
+	// batches are dropped once the retries are exhausted
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+
+	defer server.Close()
+
+	tsdb = &OpenTSDB{
+		URL:     server.URL,
+		Tagger:  Tagger{Tags: map[string]string{"host": "web"}},
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}
+
+	s.Write(tsdb)
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := tsdb.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if attempts != 2 {
+		t.Fatalf("expecting 2 attempts instead of %d", attempts)
+	}
+}
+
+// snappyDecode decodes a snappy block.
+func snappyDecode(b []byte) ([]byte, error) {
+	n, k := binary.Uvarint(b)
+	b = b[k:]
+
+	var result []byte
+	for len(b) != 0 {
+		var offset, m int
+		switch b[0] & 3 {
+		case 0:
+			m, i := int(b[0]>>2), 1
+			switch m {
+			case 60:
+				m, i = int(b[1]), 2
+			case 61:
+				m, i = int(b[1])|int(b[2])<<8, 3
+			}
+
+			result = append(result, b[i:i+m+1]...)
+			b = b[i+m+1:]
+			continue
+		case 1:
+			offset, m = int(b[0]>>5)<<8|int(b[1]), int(b[0]>>2&7)+4
+			b = b[2:]
+		case 2:
+			offset, m = int(b[1])|int(b[2])<<8, int(b[0]>>2)+1
+			b = b[3:]
+		default:
+			return nil, fmt.Errorf("unexpected copy element")
+		}
+
+		if offset == 0 || offset > len(result) {
+			return nil, fmt.Errorf("invalid offset %d", offset)
+		}
+
+		for j := 0; j < m; j++ {
+			result = append(result, result[len(result)-offset])
+		}
+	}
+
+	if uint64(len(result)) != n {
+		return nil, fmt.Errorf("expecting %d bytes instead of %d", n, len(result))
+	}
+
+	return result, nil
+}
+
+// protoFields splits a protobuf message into its fields.
+func protoFields(b []byte) (fields []struct {
+	id   uint64
+	data []byte
+}) {
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+
+		item := struct {
+			id   uint64
+			data []byte
+		}{id: key >> 3}
+
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			item.data, b = b[:n], b[n:]
+		case 1:
+			item.data, b = b[:8], b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			item.data, b = b[n:n+int(size)], b[n+int(size):]
+		}
+
+		fields = append(fields, item)
+	}
+
+	return
+}
+
+func TestPrometheusRemote(t *testing.T) {
+	series := make(chan map[string]float64, 1)
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+		request, err := snappyDecode(data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result := make(map[string]float64)
+		for _, ts := range protoFields(request) {
+			var labels []string
+			value := 0.0
+			for _, field := range protoFields(ts.data) {
+				switch field.id {
+				case 1:
+					label := protoFields(field.data)
+					labels = append(labels, string(label[0].data)+"="+string(label[1].data))
+				case 2:
+					value = math.Float64frombits(binary.LittleEndian.Uint64(protoFields(field.data)[0].data))
+				}
+			}
+
+			result[strings.Join(labels, ",")] = value
+		}
+
+		series <- result
+	}))
+
+	defer server.Close()
+
+	p := &PrometheusRemote{
+		URL:     server.URL,
+		Prefix:  "app",
+		Tagger:  Tagger{Tags: map[string]string{"job:name": "test"}},
+		Backoff: time.Millisecond,
+	}
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: 2 * time.Second,
+	}
+
+	s.Count("Requests.Count", 4)
+	s.Write(p)
+
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-series
+	if len(result) != 1 || result["__name__=app_Requests_Count,job_name=test"] != 2 {
+		t.Fatalf("unexpected series %v", result)
+	}
+
+	// repeated labels compress well and blocks larger than 64KB round trip
+	data := []byte(strings.Repeat("__name__=app_Requests_Count,job=test ", 4000))
+	for i := 0; i < 1000; i++ {
+		data = append(data, byte(i*7919>>3))
+	}
+
+	body := snappyEncode(data)
+	if len(body) > len(data)/10 {
+		t.Fatalf("expecting %d bytes to be compressed instead of %d", len(data), len(body))
+	}
+
+	if text, err := snappyDecode(body); err != nil || string(text) != string(data) {
+		t.Fatalf("expecting the data to round trip instead of %v", err)
+	}
+}
+
+func TestCarbonTags(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		data, _ := ioutil.ReadAll(conn)
+		lines <- string(data)
+	}()
+
+	carbon := &Carbon{
+		URLs: []string{"tcp://" + l.Addr().String()},
+		Tagger: &Tagger{
+			Tags:      map[string]string{"host": "web 1", "empty": ""},
+			Positions: map[string]int{"route": 1},
+		},
+	}
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: 2 * time.Second,
+	}
+
+	s.Count("Requests.home;x.Count", 4)
+	s.Write(carbon)
+
+	if err := carbon.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if text := <-lines; text != "Requests.Count;host=web_1;route=home_x 2.000000 10\n" {
+		t.Fatalf("unexpected lines %q", text)
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	syslog, err := NewSyslog("udp://"+conn.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syslog.Hostname = "host"
+	syslog.AppName = "app"
+	syslog.Severities = map[string]int{"*.Errors": 4}
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: time.Second,
+	}
+
+	s.Count("Request.Errors", 2)
+	s.Write(syslog)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// facility 0 is kern
+	expected := fmt.Sprintf(`<4>1 1970-01-01T00:00:10.000000Z host app %d metric [metric@32473 name="Request.Errors" value="2.000000"] Request.Errors=2.000000`, os.Getpid())
+	if text := string(data[:n]); text != expected {
+		t.Fatalf("expecting message %q instead of %q", expected, text)
+	}
+
+	syslog.Stop(context.Background())
+
+	// messages have no trailing newline but are counted
+	Self.Record(s)
+	m := &memory{}
+	s.Write(m)
+
+	lines := 0.0
+	for key, value := range m.values {
+		if strings.HasPrefix(key, "gometrics.Syslog.") && strings.HasSuffix(key, ".Lines") {
+			lines += value
+		}
+	}
+
+	if lines != 1 {
+		t.Fatalf("expecting 1 message in the telemetry instead of %v", m.values)
+	}
+
+	if _, err := NewSyslog("udp://127.0.0.1:514", 24); err == nil {
+		t.Fatalf("expecting an invalid facility")
+	}
+}
+
+func TestStopped(t *testing.T) {
+	var mu sync.Mutex
+	var errors []string
+	SetErrorHandler(func(err error) {
+		mu.Lock()
+		errors = append(errors, err.Error())
+		mu.Unlock()
+	})
+
+	defer SetErrorHandler(nil)
+
+	// deliveries to a closed port are retried until the reporters are stopped
+	syslog := &Syslog{URL: "tcp://127.0.0.1:1"}
+	carbon := &Carbon{URLs: []string{"tcp://127.0.0.1:1"}}
+
+	s := &Summary{
+		Time: time.Unix(10, 0),
+		Step: time.Second,
+	}
+
+	s.Set("Load", 1)
+	s.Write(syslog)
+	s.Write(carbon)
+
+	for _, r := range []Reporter{syslog, carbon} {
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := Stop(c, r); err != context.DeadlineExceeded {
+			t.Fatalf("expecting the pending delivery to time out instead of %v", err)
+		}
+
+		cancel()
+
+		if err := Stop(context.Background(), r); err != ErrStopped {
+			t.Fatalf("expecting a second stop to fail instead of %v", err)
+		}
+	}
+
+	s.Write(syslog)
+	s.Write(carbon)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	n := 0
+	for _, text := range errors {
+		if strings.HasSuffix(text, ErrStopped.Error()) {
+			n++
+		}
+	}
+
+	if n != 2 {
+		t.Fatalf("expecting 2 summaries to be dropped instead of %v", errors)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// the period is added to the name of rolled files
+	long := &CSV{
+		Filename: dir + "/long.csv",
+		Roll:     time.Hour,
+	}
+
+	wide := &CSV{
+		Filename: dir + "/wide.csv",
+		Wide:     true,
+	}
+
+	s := &Summary{Step: 2 * time.Second}
+	for i, t := range []time.Time{time.Unix(0, 0), time.Unix(3600, 0)} {
+		s.Time = t
+		if i == 0 {
+			s.Count("c", 4)
+		} else {
+			s.Log("s", "x")
+		}
+
+		s.Write(long)
+		s.Write(wide)
+		s.Reset()
+	}
+
+	long.Stop(context.Background())
+	wide.Stop(context.Background())
+
+	var errors []error
+	SetErrorHandler(func(err error) {
+		errors = append(errors, err)
+	})
+
+	defer SetErrorHandler(nil)
+
+	// the file isn't created again once stopped
+	s.Time = time.Unix(7200, 0)
+	s.Count("c", 4)
+	s.Write(long)
+
+	if len(errors) != 1 || !strings.HasSuffix(errors[0].Error(), ErrStopped.Error()) {
+		t.Fatalf("expecting summaries written after stop to be dropped instead of %v", errors)
+	}
+
+	if _, err := os.Stat(dir + "/long-1970-01-01T02.csv"); !os.IsNotExist(err) {
+		t.Fatalf("expecting no file once stopped instead of %v", err)
+	}
+
+	if err := long.Stop(context.Background()); err != ErrStopped {
+		t.Fatalf("expecting a second stop to fail instead of %v", err)
+	}
+
+	expected := map[string]string{
+		"long-1970-01-01T00.csv": "timestamp,step,name,kind,value\n1970-01-01T00:00:00Z,2,c,rate,2\n",
+		"long-1970-01-01T01.csv": "timestamp,step,name,kind,value\n1970-01-01T01:00:00Z,2,s,string,x\n1970-01-01T01:00:00Z,2,s,rate,0.5\n",
+		"wide.csv":               "timestamp,step,c\n1970-01-01T00:00:00Z,2,2\n1970-01-01T01:00:00Z,2,\n",
+	}
+
+	for name, text := range expected {
+		data, err := ioutil.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != text {
+			t.Errorf("expecting %q in '%s' instead of %q", text, name, data)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(data)
+		if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Signature") != signature {
+			t.Errorf("expecting signature '%s' instead of '%s'", signature, r.Header.Get("X-Signature"))
+		}
+
+		bodies <- string(data)
+	}))
+
+	defer server.Close()
+
+	hook := &Webhook{
+		URL:       server.URL,
+		Template:  template.Must(template.New("").Parse(`{{range .}}{{range $k, $v := .Values}}{{$k}}={{$v}};{{end}}{{end}}`)),
+		Secret:    "secret",
+		BatchSize: 2,
+	}
+
+	s := &Summary{Step: time.Second}
+	for _, name := range []string{"a", "b", "c"} {
+		s.Name = name
+		s.Count("c", 1)
+		s.Write(hook)
+		s.Reset()
+	}
+
+	if text := <-bodies; text != "a.c=1;b.c=1;" {
+		t.Fatalf("unexpected body %q", text)
+	}
+
+	if err := hook.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if text := <-bodies; text != "c.c=1;" {
+		t.Fatalf("unexpected body %q", text)
+	}
+
+	// rates of an empty period are skipped and the other values are still posted
+	hook = &Webhook{URL: server.URL, Secret: "secret"}
+	s = &Summary{Name: "d"}
+	s.Count("c", 1)
+	s.Set("g", 2)
+	s.Write(hook)
+
+	if err := hook.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []WebhookSummary
+	if err := json.Unmarshal([]byte(<-bodies), &batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch) != 1 || len(batch[0].Values) != 1 || batch[0].Values["d.g"] != 2 {
+		t.Fatalf("expecting only the finite values instead of %+v", batch)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := &History{
+		Periods:     3,
+		Resolutions: []time.Duration{2 * time.Second},
+		Clock:       NewFakeClock(time.Unix(3603, 0)),
+	}
+
+	s := &Summary{Step: time.Second}
+	for i := 0; i < 5; i++ {
+		s.Time = time.Unix(int64(i), 0)
+		s.Count("c", i)
+		s.Log("s", "x")
+		s.Write(h)
+		s.Reset()
+	}
+
+	if keys := h.Keys(); len(keys) != 2 || keys[0] != "c" || keys[1] != "s" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "?match=c&from=1970-01-01T00:00:00Z&to=1970-01-01T00:01:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Body.Close()
+
+	result := make(map[string][]Point)
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the last 3 periods are kept
+	if p := result["c"]; len(result) != 1 || len(p) != 3 || p[0].Value != 2 || p[2].Value != 4 || p[2].Time.Unix() != 4 {
+		t.Fatalf("unexpected points %v", result)
+	}
+
+	// complete buckets of 2 seconds are averaged
+	p := h.Query("c", time.Unix(0, 0), time.Unix(60, 0), time.Minute)["c"]
+	if len(p) != 2 || p[0].Value != 0.5 || p[1].Value != 2.5 || p[1].Time.Unix() != 2 {
+		t.Fatalf("unexpected downsampled points %v", p)
+	}
+
+	// the last hour is returned by default
+	r, err = http.Get(server.URL + "?match=c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Body.Close()
+
+	result = make(map[string][]Point)
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := result["c"]; len(p) != 2 || p[0].Time.Unix() != 3 {
+		t.Fatalf("unexpected points in the last hour %v", result)
+	}
+
+	// keys are evicted once they are older than 3 periods of 2 seconds
+	s = &Summary{Step: time.Second, Time: time.Unix(11, 0)}
+	s.Set("g", 1)
+	s.Write(h)
+
+	if keys := h.Keys(); len(keys) != 1 || keys[0] != "g" {
+		t.Fatalf("expecting stale keys to be evicted instead of %v", keys)
+	}
+
+	// rates of an empty period are skipped so that the points can be served
+	s = &Summary{Time: time.Unix(12, 0)}
+	s.Count("r", 1)
+	s.Set("g", 2)
+	s.Write(h)
+
+	r, err = http.Get(server.URL + "?from=0&to=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Body.Close()
+
+	result = make(map[string][]Point)
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := result["g"]; len(result) != 1 || len(p) != 2 || p[1].Value != 2 {
+		t.Fatalf("expecting only the finite values instead of %v", result)
+	}
+}
+
+// expvarRuns makes the published names unique when the tests are run repeatedly.
+var expvarRuns int
+
+func TestExpvar(t *testing.T) {
+	expvarRuns++
+	name := func(s string) string {
+		return fmt.Sprintf("test%d-%s", expvarRuns, s)
+	}
+
+	e := &Expvar{Name: name("metrics")}
+
+	s := &Summary{Step: 2 * time.Second}
+	s.Count("c", 4)
+	s.Log("s", "x")
+	s.Write(e)
+
+	var result struct {
+		Values  map[string]float64
+		Strings map[string][]string
+	}
+
+	if err := json.Unmarshal([]byte(expvar.Get(name("metrics")).String()), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Values["c"] != 2 || result.Values["s"] != 0.5 || len(result.Strings["s"]) != 1 {
+		t.Fatalf("unexpected variable %v", result)
+	}
+
+	// rates of an empty period are skipped so that the variable stays valid
+	empty := &Summary{}
+	empty.Count("r", 1)
+	empty.Write(e)
+
+	if err := json.Unmarshal([]byte(expvar.Get(name("metrics")).String()), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := result.Values["r"]; ok {
+		t.Fatalf("expecting non-finite values to be skipped instead of %v", result)
+	}
+
+	requests := expvar.NewInt(name("requests"))
+	stats := expvar.NewMap(name("stats"))
+	stats.Add("open", 3)
+
+	c := &ExpvarCollector{
+		Names:    []string{name("*")},
+		Counters: []string{name("requests")},
+		Prefix:   "vars",
+	}
+
+	collected := &Summary{Step: time.Second}
+	for i := 0; i < 2; i++ {
+		requests.Add(5)
+		c.Collect(collected)
+	}
+
+	m := &memory{}
+	collected.Write(m)
+
+	if m.values["vars."+name("requests")] != 5 || m.values["vars."+name("stats")+".open"] == 0 {
+		t.Fatalf("unexpected collected metrics %v", m.values)
+	}
+
+	if _, ok := m.values["vars."+name("metrics")+".c"]; ok {
+		t.Fatalf("expecting published metrics to be skipped")
+	}
+}
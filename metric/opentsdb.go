@@ -0,0 +1,306 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	"golang.org/x/net/context"
+)
+
+// OpenTSDB enables writing summary of metrics to an OpenTSDB server.
+// Keys are split into a metric name and tags by the Tagger and written like Carbon does e.g. rates are scaled by the period.
+// Since OpenTSDB requires at least one tag per data point, metrics without tags are rejected.
+// Over TCP, data points are sent as put lines with the same reconnect model as Carbon.
+// Over HTTP, they are posted as JSON to the /api/put endpoint and retried on network errors, throttling or server errors.
+type OpenTSDB struct {
+	// URL contains the address of the server e.g. tcp://127.0.0.1:4242 or http://127.0.0.1:4242.
+	URL string
+	// Prefix contains the path under which all metrics will be written.
+	Prefix string
+	// Tagger extracts the tags of every metric from its key.
+	Tagger Tagger
+	// Client is optional and contains the HTTP client used to post data points.
+	Client *http.Client
+	// Timeout contains the time limit of every request when no client is specified. Will use 10s if 0.
+	Timeout time.Duration
+	// BatchSize contains the maximum number of data points per HTTP request. Will use 50 if 0.
+	BatchSize int
+	// Retries contains the number of attempts made to post a batch before dropping it. Will use 3 if 0.
+	Retries int
+	// Backoff contains the delay before the first retry and doubles after every attempt up to a minute. Will use 1s if 0.
+	Backoff time.Duration
+
+	once   sync.Once
+	busy   deliveries
+	path   string
+	conn   *carbonConn
+	target string
+	quit   chan struct{}
+}
+
+// NewOpenTSDB returns a reporter that writes metrics under the prefix to the OpenTSDB server at the specified URL.
+// It returns an error if the URL is invalid or uses an unsupported transport.
+func NewOpenTSDB(prefix, address string, tags map[string]string) (*OpenTSDB, error) {
+	if _, err := parseOpenTSDBAddress(address); err != nil {
+		return nil, err
+	}
+
+	return &OpenTSDB{URL: address, Prefix: prefix, Tagger: Tagger{Tags: tags}}, nil
+}
+
+// parseOpenTSDBAddress validates an URL like tcp://127.0.0.1:4242 or http://127.0.0.1:4242.
+func parseOpenTSDBAddress(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("opentsdb: invalid url '%s': %s", address, err)
+	}
+
+	switch u.Scheme {
+	case "tcp", "http", "https":
+	default:
+		return nil, fmt.Errorf("opentsdb: invalid url '%s': unsupported transport '%s'", address, u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("opentsdb: invalid url '%s': missing address", address)
+	}
+
+	return u, nil
+}
+
+// NewWriter creates a new writer that collects the data points of the summary.
+// Data points are sent when the writer is closed.
+func (tsdb *OpenTSDB) NewWriter(s *Summary) Writer {
+	tsdb.once.Do(tsdb.initialize)
+
+	return &openTSDBWriter{
+		tsdb: tsdb,
+		dt:   s.Step.Seconds(),
+		time: s.Time.Unix(),
+	}
+}
+
+func (tsdb *OpenTSDB) initialize() {
+	tsdb.Backoff = defaults.Duration(tsdb.Backoff, time.Second)
+	tsdb.quit = make(chan struct{})
+
+	if tsdb.Client == nil {
+		tsdb.Client = &http.Client{
+			Timeout: defaults.Duration(tsdb.Timeout, 10*time.Second),
+		}
+	}
+
+	if tsdb.BatchSize == 0 {
+		tsdb.BatchSize = 50
+	}
+
+	if tsdb.Retries == 0 {
+		tsdb.Retries = 3
+	}
+
+	tsdb.path = tsdb.Prefix
+	if tsdb.path != "" && !strings.HasSuffix(tsdb.path, ".") {
+		tsdb.path += "."
+	}
+
+	u, err := parseOpenTSDBAddress(tsdb.URL)
+	if err != nil {
+		HandleError(err)
+		return
+	}
+
+	if u.Scheme == "tcp" {
+		tsdb.conn = newCarbonConn("OpenTSDB", u.Scheme, u.Host)
+		go tsdb.conn.run()
+		return
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api/put"
+	}
+
+	tsdb.target = u.String()
+}
+
+// Stop waits for the pending data points to be delivered.
+// When the context is done first, pending data points are dropped.
+// Data points written afterwards are dropped and stopping again returns ErrStopped.
+func (tsdb *OpenTSDB) Stop(c context.Context) error {
+	tsdb.once.Do(tsdb.initialize)
+
+	err := tsdb.busy.stop(c)
+	if err == ErrStopped {
+		return err
+	}
+
+	close(tsdb.quit)
+	if tsdb.conn != nil {
+		tsdb.conn.stop()
+	}
+
+	return err
+}
+
+// openTSDBPoint contains a data point in the format of the /api/put endpoint.
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// send delivers the data points over the connection or in batches over HTTP.
+func (tsdb *OpenTSDB) send(points []openTSDBPoint) {
+	if tsdb.conn != nil {
+		var b bytes.Buffer
+		for _, p := range points {
+			fmt.Fprintf(&b, "put %s %d %s", p.Metric, p.Timestamp, strconv.FormatFloat(p.Value, 'f', -1, 64))
+			for _, key := range sortedTags(p.Tags) {
+				fmt.Fprintf(&b, " %s=%s", key, p.Tags[key])
+			}
+
+			b.WriteByte('\n')
+		}
+
+		done := make(chan struct{})
+		ok := tsdb.conn.deliver(func() {
+			tsdb.conn.send(b.Bytes(), len(points))
+			close(done)
+		})
+
+		if ok {
+			<-done
+		}
+
+		return
+	}
+
+	if tsdb.target == "" {
+		return
+	}
+
+	for i := 0; i < len(points); i += tsdb.BatchSize {
+		j := i + tsdb.BatchSize
+		if j > len(points) {
+			j = len(points)
+		}
+
+		body, err := json.Marshal(points[i:j])
+		if err != nil {
+			HandleError(fmt.Errorf("opentsdb: %s", err))
+			continue
+		}
+
+		backoff := Backoff{Delay: tsdb.Backoff, Attempts: tsdb.Retries}
+		err = backoff.Retry(tsdb.quit, func(attempt int) (bool, error) {
+			retry, err := tsdb.post(body)
+			if err != nil {
+				HandleError(fmt.Errorf("opentsdb: %s", err))
+				Self.Count("OpenTSDB.Errors", 1)
+			}
+
+			return retry, err
+		})
+
+		if err != nil {
+			HandleError(fmt.Errorf("opentsdb: dropping %d data points for '%s'", j-i, tsdb.URL))
+			continue
+		}
+
+		Self.Count("OpenTSDB.Bytes", float64(len(body)))
+		Self.Count("OpenTSDB.Points", float64(j-i))
+	}
+}
+
+// post sends the body once and returns whether a failure can be retried.
+func (tsdb *OpenTSDB) post(body []byte) (retry bool, err error) {
+	r, err := tsdb.Client.Post(tsdb.target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		retry = true
+		return
+	}
+
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		retry = true
+		return
+	}
+
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		retry = r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+		err = fmt.Errorf("unexpected status '%s' from '%s': %s", r.Status, tsdb.target, bytes.TrimSpace(data))
+	}
+
+	return
+}
+
+type openTSDBWriter struct {
+	tsdb   *OpenTSDB
+	dt     float64
+	time   int64
+	points []openTSDBPoint
+}
+
+func (w *openTSDBWriter) Write(name string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("opentsdb: invalid value %f for '%s'", value, name)
+	}
+
+	metric, tags := w.tsdb.Tagger.Split(name)
+	if len(tags) == 0 {
+		return fmt.Errorf("opentsdb: no tag for '%s'", name)
+	}
+
+	clean := make(map[string]string, len(tags))
+	for k, v := range tags {
+		clean[rewrite(SanitizeOpenTSDB, k)] = rewrite(SanitizeOpenTSDB, v)
+	}
+
+	w.points = append(w.points, openTSDBPoint{
+		Metric:    rewrite(SanitizeOpenTSDB, w.tsdb.path+metric),
+		Timestamp: w.time,
+		Value:     value,
+		Tags:      clean,
+	})
+
+	return nil
+}
+
+func (w *openTSDBWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *openTSDBWriter) WriteString(name, text string) error {
+	return ErrIgnored
+}
+
+func (w *openTSDBWriter) Close() {
+	if len(w.points) == 0 {
+		return
+	}
+
+	if !w.tsdb.busy.add() {
+		HandleError(fmt.Errorf("opentsdb: dropping %d data points: %s", len(w.points), ErrStopped))
+		return
+	}
+
+	go func() {
+		defer w.tsdb.busy.done()
+		w.tsdb.send(w.points)
+	}()
+}
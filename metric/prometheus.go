@@ -0,0 +1,385 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	"golang.org/x/net/context"
+)
+
+// PrometheusRemote enables pushing summary of metrics to an endpoint implementing the Prometheus remote_write protocol e.g. Cortex, Mimir or Thanos.
+// Every key becomes a series named after the sanitized key and labeled by the Tagger.
+// Requests are encoded in protobuf and compressed with snappy.
+// Rates are scaled by the period like Carbon does.
+// Requests are sent in the background and retried on network errors, throttling or server errors.
+type PrometheusRemote struct {
+	// URL contains the address of the endpoint e.g. http://127.0.0.1:9009/api/v1/push.
+	URL string
+	// Prefix contains the path under which all series will be written.
+	Prefix string
+	// Tagger extracts the labels of every series from its key.
+	Tagger Tagger
+	// Client is optional and contains the HTTP client used to push series.
+	Client *http.Client
+	// Timeout contains the time limit of every request when no client is specified. Will use 10s if 0.
+	Timeout time.Duration
+	// Header contains additional headers sent with every request e.g. for authentication or the tenant.
+	Header http.Header
+	// BatchSize contains the maximum number of series per request. Will use 500 if 0.
+	BatchSize int
+	// Retries contains the number of attempts made to push a batch before dropping it. Will use 3 if 0.
+	Retries int
+	// Backoff contains the delay before the first retry and doubles after every attempt up to a minute. Will use 1s if 0.
+	Backoff time.Duration
+
+	once sync.Once
+	busy deliveries
+	path string
+	quit chan struct{}
+}
+
+// NewWriter creates a new writer that collects the series of the summary.
+// Series are pushed when the writer is closed.
+func (p *PrometheusRemote) NewWriter(s *Summary) Writer {
+	p.once.Do(p.initialize)
+
+	return &prometheusWriter{
+		p:    p,
+		dt:   s.Step.Seconds(),
+		time: s.Time.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (p *PrometheusRemote) initialize() {
+	p.Backoff = defaults.Duration(p.Backoff, time.Second)
+	p.quit = make(chan struct{})
+
+	if p.Client == nil {
+		p.Client = &http.Client{
+			Timeout: defaults.Duration(p.Timeout, 10*time.Second),
+		}
+	}
+
+	if p.BatchSize == 0 {
+		p.BatchSize = 500
+	}
+
+	if p.Retries == 0 {
+		p.Retries = 3
+	}
+
+	p.path = p.Prefix
+	if p.path != "" && !strings.HasSuffix(p.path, ".") {
+		p.path += "."
+	}
+}
+
+// Stop waits for the pending series to be pushed.
+// When the context is done first, the remaining retries are aborted.
+// Series written afterwards are dropped and stopping again returns ErrStopped.
+func (p *PrometheusRemote) Stop(c context.Context) error {
+	p.once.Do(p.initialize)
+
+	err := p.busy.stop(c)
+	if err != ErrStopped {
+		close(p.quit)
+	}
+
+	return err
+}
+
+// send pushes the series in batches.
+func (p *PrometheusRemote) send(series []prometheusSeries) {
+	for i := 0; i < len(series); i += p.BatchSize {
+		j := i + p.BatchSize
+		if j > len(series) {
+			j = len(series)
+		}
+
+		body := snappyEncode(encodeWriteRequest(series[i:j]))
+		if !p.sendWithRetries(body) {
+			HandleError(fmt.Errorf("prometheus: dropping %d series for '%s'", j-i, p.URL))
+			Self.Count("Prometheus.Dropped", float64(j-i))
+			continue
+		}
+
+		Self.Count("Prometheus.Bytes", float64(len(body)))
+		Self.Count("Prometheus.Series", float64(j-i))
+	}
+}
+
+// sendWithRetries pushes the body until it succeeds, fails permanently or the number of retries is exhausted.
+func (p *PrometheusRemote) sendWithRetries(body []byte) bool {
+	backoff := Backoff{Delay: p.Backoff, Attempts: p.Retries}
+	return backoff.Retry(p.quit, func(attempt int) (bool, error) {
+		retry, err := p.post(body)
+		if err != nil {
+			HandleError(fmt.Errorf("prometheus: %s", err))
+			Self.Count("Prometheus.Errors", 1)
+		}
+
+		return retry, err
+	}) == nil
+}
+
+// post pushes the body once and returns whether a failure can be retried.
+func (p *PrometheusRemote) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	for key, values := range p.Header {
+		req.Header[key] = values
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	r, err := p.Client.Do(req)
+	if err != nil {
+		retry = true
+		return
+	}
+
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		retry = true
+		return
+	}
+
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		// the protocol only allows retrying on throttling and server errors
+		retry = r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+		err = fmt.Errorf("unexpected status '%s' from '%s': %s", r.Status, p.URL, bytes.TrimSpace(data))
+	}
+
+	return
+}
+
+// prometheusSeries contains a series with a single sample.
+type prometheusSeries struct {
+	labels []prometheusLabel
+	value  float64
+	time   int64
+}
+
+type prometheusLabel struct {
+	name  string
+	value string
+}
+
+type prometheusWriter struct {
+	p      *PrometheusRemote
+	dt     float64
+	time   int64
+	series []prometheusSeries
+}
+
+func (w *prometheusWriter) Write(name string, value float64) error {
+	metric, tags := w.p.Tagger.Split(name)
+
+	labels := make([]prometheusLabel, 0, len(tags)+1)
+	labels = append(labels, prometheusLabel{"__name__", rewrite(SanitizePrometheus, w.p.path+metric)})
+	for k, v := range tags {
+		labels = append(labels, prometheusLabel{rewrite(SanitizePrometheusLabel, k), v})
+	}
+
+	// labels must be sorted by name
+	sort.Sort(prometheusLabels(labels))
+
+	w.series = append(w.series, prometheusSeries{
+		labels: labels,
+		value:  value,
+		time:   w.time,
+	})
+
+	return nil
+}
+
+func (w *prometheusWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *prometheusWriter) WriteString(name, text string) error {
+	return ErrIgnored
+}
+
+func (w *prometheusWriter) Close() {
+	if len(w.series) == 0 {
+		return
+	}
+
+	if !w.p.busy.add() {
+		HandleError(fmt.Errorf("prometheus: dropping %d series: %s", len(w.series), ErrStopped))
+		return
+	}
+
+	go func() {
+		defer w.p.busy.done()
+		w.p.send(w.series)
+	}()
+}
+
+type prometheusLabels []prometheusLabel
+
+func (l prometheusLabels) Len() int           { return len(l) }
+func (l prometheusLabels) Less(i, j int) bool { return l[i].name < l[j].name }
+func (l prometheusLabels) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// encodeWriteRequest encodes the series as a remote_write WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []prometheusSeries) []byte {
+	var request, ts, item []byte
+
+	for _, s := range series {
+		ts = ts[:0]
+		for _, label := range s.labels {
+			item = item[:0]
+			item = appendBytes(item, 1, []byte(label.name))
+			item = appendBytes(item, 2, []byte(label.value))
+			ts = appendBytes(ts, 1, item)
+		}
+
+		item = item[:0]
+		item = appendVarint(item, 1<<3|1)
+		item = appendFixed64(item, math.Float64bits(s.value))
+		item = appendVarint(item, 2<<3)
+		item = appendVarint(item, uint64(s.time))
+		ts = appendBytes(ts, 2, item)
+
+		request = appendBytes(request, 1, ts)
+	}
+
+	return request
+}
+
+// appendBytes appends a length-delimited field.
+func appendBytes(b []byte, field uint64, data []byte) []byte {
+	b = appendVarint(b, field<<3|2)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buffer[:], v)
+	return append(b, buffer[:n]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], v)
+	return append(b, buffer[:]...)
+}
+
+// snappyEncode compresses the data in the snappy block format.
+// Every 64KB of input is matched independently with a greedy search of 4-byte sequences.
+func snappyEncode(data []byte) []byte {
+	b := appendVarint(make([]byte, 0, len(data)+len(data)/6+16), uint64(len(data)))
+
+	for len(data) != 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+
+		b = snappyBlock(b, data[:n])
+		data = data[n:]
+	}
+
+	return b
+}
+
+// snappyBlock appends the literals and copies of a block of at most 64KB.
+func snappyBlock(b, src []byte) []byte {
+	const bits = 14
+
+	// table contains the last position + 1 of every hashed sequence
+	var table [1 << bits]int32
+
+	load := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:])
+	}
+
+	lit := 0
+	for s := 0; s+4 <= len(src); {
+		v := load(s)
+		h := v * 0x1e35a7bd >> (32 - bits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(s + 1)
+
+		if candidate < 0 || load(candidate) != v {
+			s++
+			continue
+		}
+
+		n := 4
+		for s+n < len(src) && src[candidate+n] == src[s+n] {
+			n++
+		}
+
+		b = snappyLiteral(b, src[lit:s])
+		b = snappyCopy(b, s-candidate, n)
+		s += n
+		lit = s
+	}
+
+	return snappyLiteral(b, src[lit:])
+}
+
+func snappyLiteral(b, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+
+	switch n := len(data) - 1; {
+	case n < 60:
+		b = append(b, byte(n)<<2)
+	case n < 1<<8:
+		b = append(b, 60<<2, byte(n))
+	default:
+		b = append(b, 61<<2, byte(n), byte(n>>8))
+	}
+
+	return append(b, data...)
+}
+
+// snappyCopy appends copy elements of at most 64 bytes with the shortest encoding.
+func snappyCopy(b []byte, offset, n int) []byte {
+	for n >= 68 {
+		b = append(b, 63<<2|2, byte(offset), byte(offset>>8))
+		n -= 64
+	}
+
+	// keep at least 4 bytes for the last element
+	if n > 64 {
+		b = append(b, 59<<2|2, byte(offset), byte(offset>>8))
+		n -= 60
+	}
+
+	if n >= 12 || offset >= 2048 {
+		return append(b, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+
+	return append(b, byte(offset>>8)<<5|byte(n-4)<<2|1, byte(offset))
+}
@@ -2,11 +2,20 @@
 
 package metric
 
-import "errors"
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	"golang.org/x/net/context"
+)
 
 var (
 	// ErrIgnored indicates that a writer ignores a metric.
 	ErrIgnored = errors.New("ignored")
+	// ErrStopped indicates that a reporter is already stopped.
+	ErrStopped = errors.New("stopped")
 )
 
 // Writer implements a kind of reporting for every metrics.
@@ -21,3 +30,110 @@ type Writer interface {
 type Reporter interface {
 	NewWriter(s *Summary) Writer
 }
+
+// Stopper is implemented by reporters that deliver metrics in the background.
+// Stop waits until the pending metrics are delivered or the context is done and releases the background resources.
+// The reporter can't be used once stopped.
+type Stopper interface {
+	Stop(c context.Context) error
+}
+
+// Stop stops the reporter if it implements the Stopper interface.
+func Stop(c context.Context, r Reporter) error {
+	if s, ok := r.(Stopper); ok {
+		return s.Stop(c)
+	}
+
+	return nil
+}
+
+// wait blocks until the wait group is done or the context is done.
+func wait(c context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// deliveries tracks the background deliveries of a reporter and refuses new ones once it is stopped.
+type deliveries struct {
+	mu      sync.Mutex
+	busy    sync.WaitGroup
+	stopped bool
+}
+
+// add registers a new delivery and returns false if the reporter is stopped.
+func (d *deliveries) add() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return false
+	}
+
+	d.busy.Add(1)
+	return true
+}
+
+// done marks the end of a delivery.
+func (d *deliveries) done() {
+	d.busy.Done()
+}
+
+// stop refuses new deliveries and waits for the pending ones or until the context is done.
+// It returns ErrStopped if it was already called.
+func (d *deliveries) stop(c context.Context) error {
+	d.mu.Lock()
+	stopped := d.stopped
+	d.stopped = true
+	d.mu.Unlock()
+
+	if stopped {
+		return ErrStopped
+	}
+
+	return wait(c, &d.busy)
+}
+
+// Backoff defines how deliveries are retried with a delay that doubles after every attempt.
+type Backoff struct {
+	// Delay contains the delay before the first retry. Will use 1s if 0.
+	Delay time.Duration
+	// Limit contains the maximum delay between attempts. Will use 1m if 0.
+	Limit time.Duration
+	// Attempts contains the maximum number of attempts. There is no limit if 0.
+	Attempts int
+}
+
+// Retry calls the function until it succeeds, fails permanently or the attempts are exhausted.
+// The function returns whether its failure can be retried.
+// Retry returns the last error or ErrStopped if the quit channel is closed while waiting to retry.
+func (b Backoff) Retry(quit <-chan struct{}, f func(attempt int) (retry bool, err error)) error {
+	sleep := defaults.Duration(b.Delay, time.Second)
+	limit := defaults.Duration(b.Limit, time.Minute)
+
+	for attempt := 0; ; attempt++ {
+		retry, err := f(attempt)
+		if err == nil || !retry || attempt+1 == b.Attempts {
+			return err
+		}
+
+		select {
+		case <-quit:
+			return ErrStopped
+		case <-time.After(sleep):
+		}
+
+		if sleep += sleep; sleep > limit {
+			sleep = limit
+		}
+	}
+}
@@ -2,6 +2,8 @@
 
 package metric
 
+import "golang.org/x/net/context"
+
 // Stack implements a fallback mechanism when a writer ignores a type of metric.
 // For each specified reporter, an associated writer is created.
 // When a writer indicates that the value was ignored, the next writer is used until the stack is exhausted.
@@ -24,6 +26,18 @@ func (stack *Stack) NewWriter(s *Summary) (result Writer) {
 	return w
 }
 
+// Stop stops every reporter of the stack.
+// It returns the first error encountered.
+func (stack *Stack) Stop(c context.Context) (err error) {
+	for _, item := range stack.Items {
+		if e := Stop(c, item); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
 type stackWriter struct {
 	list []Writer
 }
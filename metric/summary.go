@@ -30,11 +30,36 @@ type Summary struct {
 	Time time.Time
 	// Step contains the duration of the aggreation period.
 	Step time.Duration
+	// Clock provides the current time to the gauges of the summary.
+	// Will use DefaultClock if nil.
+	Clock Clock
+	// MaxKeys contains the maximum number of distinct keys.
+	// Records for new keys past that limit are redirected to the overflow bucket.
+	// There is no limit if 0.
+	MaxKeys int
+	// Limits contains the maximum number of distinct keys under a given prefix.
+	// Records for new keys past that limit are redirected to the overflow bucket of the prefix.
+	Limits map[string]int
+	// Expiry contains the number of periods without any record after which a key is removed on Reset.
+	// Keys are kept forever if 0.
+	Expiry int
+	// ExpireGauges also removes stale gauges.
+	// By default, gauges keep reporting their last level even when they are no longer set.
+	ExpireGauges bool
+
+	count  int
+	counts map[string]int
+	period int
+	seen   map[string]int
+	// rejected contains the keys redirected to an overflow bucket during the period.
+	rejected map[string]bool
 }
 
 // Write goes over each aggregated metric and writes its value to the reporter's writer.
+// The write errors and the duration of the report are added to the telemetry of the reporter.
 func (summary *Summary) Write(r Reporter) {
-	w := r.NewWriter(summary)
+	start := clockOf(summary.Clock).Now()
+	w := &telemetryWriter{Writer: r.NewWriter(summary)}
 
 	path := summary.Name
 	if path != "" && !strings.HasSuffix(path, ".") {
@@ -46,22 +71,47 @@ func (summary *Summary) Write(r Reporter) {
 	}
 
 	w.Close()
+
+	name := "Reporter." + reporterName(r)
+	Self.Count(name+".Errors", float64(w.errors))
+	Self.Set(name+".Duration", since(summary.Clock, start))
 }
 
 // Reset goes over each aggregated metric and reset its state.
+// Keys that expired are removed.
 func (summary *Summary) Reset() {
-	for _, item := range summary.Keys {
+	summary.period++
+	summary.rejected = nil
+
+	for name, item := range summary.Keys {
+		if summary.expired(name, item) {
+			summary.Remove(name)
+			continue
+		}
+
 		item.Reset()
 	}
 }
 
+// Remove deletes a key e.g. when the source of a gauge disappears.
+func (summary *Summary) Remove(name string) {
+	if _, ok := summary.Keys[name]; !ok {
+		return
+	}
+
+	delete(summary.Keys, name)
+	delete(summary.seen, name)
+	summary.track(name, -1)
+}
+
 // Count updates a Counter metric.
 func (summary *Summary) Count(name string, value interface{}) {
 	item, ok := summary.Keys[name]
 	if !ok {
-		item = summary.create(name, new(Counter))
+		name, item = summary.create(name, new(Counter))
 	}
 
+	summary.touch(name)
 	item.Record(value)
 }
 
@@ -69,9 +119,10 @@ func (summary *Summary) Count(name string, value interface{}) {
 func (summary *Summary) Set(name string, value interface{}) {
 	item, ok := summary.Keys[name]
 	if !ok {
-		item = summary.create(name, new(Gauge))
+		name, item = summary.create(name, &Gauge{Clock: summary.Clock})
 	}
 
+	summary.touch(name)
 	item.Record(value)
 }
 
@@ -79,9 +130,10 @@ func (summary *Summary) Set(name string, value interface{}) {
 func (summary *Summary) Record(name string, value interface{}) {
 	item, ok := summary.Keys[name]
 	if !ok {
-		item = summary.create(name, new(Histogram))
+		name, item = summary.create(name, new(Histogram))
 	}
 
+	summary.touch(name)
 	item.Record(value)
 }
 
@@ -89,17 +141,57 @@ func (summary *Summary) Record(name string, value interface{}) {
 func (summary *Summary) Log(name string, value interface{}) {
 	item, ok := summary.Keys[name]
 	if !ok {
-		item = summary.create(name, new(Labels))
+		name, item = summary.create(name, new(Labels))
 	}
 
+	summary.touch(name)
 	item.Record(value)
 }
 
-func (summary *Summary) create(name string, item Metric) Metric {
+func (summary *Summary) create(name string, item Metric) (string, Metric) {
 	if summary.Keys == nil {
 		summary.Keys = make(map[string]Metric)
 	}
 
+	name = summary.admit(name, item)
+	if existing, ok := summary.Keys[name]; ok {
+		return name, existing
+	}
+
 	summary.Keys[name] = item
-	return item
+	summary.track(name, 1)
+	return name, item
+}
+
+// touch marks the key as recorded during the current period.
+func (summary *Summary) touch(name string) {
+	if summary.Expiry == 0 {
+		return
+	}
+
+	if summary.seen == nil {
+		summary.seen = make(map[string]int)
+	}
+
+	summary.seen[name] = summary.period
+}
+
+// expired returns true if the key wasn't recorded for more than the expiry number of periods.
+func (summary *Summary) expired(name string, item Metric) bool {
+	if summary.Expiry == 0 {
+		return false
+	}
+
+	if _, ok := item.(*Gauge); ok && !summary.ExpireGauges {
+		return false
+	}
+
+	last, ok := summary.seen[name]
+	if !ok {
+		// keys created before enabling the expiry start from now
+		summary.touch(name)
+		return false
+	}
+
+	return summary.period-last > summary.Expiry
 }
@@ -0,0 +1,281 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Syslog generates a RFC 5424 message for each metric and sends it to a syslog daemon.
+// The name and value of the metric are also attached as a structured-data element.
+// Messages are delivered with the same reconnect model as Carbon.
+type Syslog struct {
+	// URL contains the address of the daemon e.g. unixgram:///dev/log, udp://127.0.0.1:514 or tcp://127.0.0.1:601.
+	// Messages are framed with octet counting over TCP. Will use unixgram:///dev/log if empty.
+	URL string
+	// Facility is optional and contains the facility of messages between 0 (kern) and 23 (local7). Will use 16 (local0) if nil.
+	Facility *int
+	// Severity is optional and contains the severity of messages between 0 (emerg) and 7 (debug). Will use 6 (informational) if nil.
+	Severity *int
+	// Severities overrides the severity of the metrics matching a glob pattern e.g. {"*.Errors": 4} for warnings.
+	// Patterns are tried in lexical order and invalid severities are ignored.
+	Severities map[string]int
+	// Hostname is optional and contains the name of the host sending the messages. Will use os.Hostname if empty.
+	Hostname string
+	// AppName is optional and contains the name of the application sending the messages. Will use the name of the executable if empty.
+	AppName string
+	// SDID contains the identifier of the structured-data element. Will use 'metric@32473' if empty.
+	SDID string
+
+	once     sync.Once
+	busy     deliveries
+	conn     *carbonConn
+	stream   bool
+	header   string
+	patterns []string
+	facility int
+	severity int
+}
+
+// NewSyslog returns a reporter that sends a message for each metric to the syslog daemon at the specified URL.
+// It returns an error if the URL is invalid, uses an unsupported transport or if the facility is out of range.
+func NewSyslog(address string, facility int) (*Syslog, error) {
+	if _, _, err := parseSyslogAddress(address); err != nil {
+		return nil, err
+	}
+
+	if err := checkSyslogRange("facility", facility, 23); err != nil {
+		return nil, err
+	}
+
+	return &Syslog{URL: address, Facility: &facility}, nil
+}
+
+// checkSyslogRange returns an error if the value isn't between 0 and the maximum.
+func checkSyslogRange(name string, value, max int) error {
+	if value < 0 || value > max {
+		return fmt.Errorf("syslog: invalid %s %d: must be between 0 and %d", name, value, max)
+	}
+
+	return nil
+}
+
+// parseSyslogAddress splits an URL like udp://127.0.0.1:514 or unixgram:///dev/log into the network and the address used to dial.
+func parseSyslogAddress(address string) (network, host string, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		err = fmt.Errorf("syslog: invalid url '%s': %s", address, err)
+		return
+	}
+
+	switch u.Scheme {
+	case "unixgram":
+		network, host = u.Scheme, u.Path
+	case "udp", "tcp":
+		network, host = u.Scheme, u.Host
+	default:
+		err = fmt.Errorf("syslog: invalid url '%s': unsupported transport '%s'", address, u.Scheme)
+		return
+	}
+
+	if host == "" {
+		err = fmt.Errorf("syslog: invalid url '%s': missing address", address)
+	}
+
+	return
+}
+
+// NewWriter returns a writer that generates the messages of the summary.
+// Messages are sent when the writer is closed.
+func (syslog *Syslog) NewWriter(s *Summary) Writer {
+	syslog.once.Do(syslog.initialize)
+
+	return &syslogWriter{
+		syslog: syslog,
+		dt:     s.Step.Seconds(),
+		time:   s.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+	}
+}
+
+func (syslog *Syslog) initialize() {
+	if syslog.URL == "" {
+		syslog.URL = "unixgram:///dev/log"
+	}
+
+	// out of range values would produce invalid priorities
+	syslog.facility, syslog.severity = 16, 6
+	if syslog.Facility != nil {
+		if err := checkSyslogRange("facility", *syslog.Facility, 23); err != nil {
+			HandleError(err)
+		} else {
+			syslog.facility = *syslog.Facility
+		}
+	}
+
+	if syslog.Severity != nil {
+		if err := checkSyslogRange("severity", *syslog.Severity, 7); err != nil {
+			HandleError(err)
+		} else {
+			syslog.severity = *syslog.Severity
+		}
+	}
+
+	if syslog.SDID == "" {
+		syslog.SDID = "metric@32473"
+	}
+
+	if syslog.Hostname == "" {
+		syslog.Hostname, _ = os.Hostname()
+	}
+
+	if syslog.AppName == "" {
+		syslog.AppName = filepath.Base(os.Args[0])
+	}
+
+	// the header fields are printable characters without spaces or '-' when empty
+	field := func(text string, n int) string {
+		text = rewrite(SanitizeCarbon, text)
+		if len(text) > n {
+			text = text[:n]
+		}
+
+		if text == "" {
+			text = "-"
+		}
+
+		return text
+	}
+
+	for pattern, severity := range syslog.Severities {
+		if err := checkSyslogRange("severity", severity, 7); err != nil {
+			HandleError(fmt.Errorf("%s for '%s'", err, pattern))
+			continue
+		}
+
+		syslog.patterns = append(syslog.patterns, pattern)
+	}
+
+	sort.Strings(syslog.patterns)
+
+	syslog.header = fmt.Sprintf("%s %s %d", field(syslog.Hostname, 255), field(syslog.AppName, 48), os.Getpid())
+
+	network, host, err := parseSyslogAddress(syslog.URL)
+	if err != nil {
+		HandleError(err)
+		return
+	}
+
+	syslog.stream = network == "tcp"
+	syslog.conn = newCarbonConn("Syslog", network, host)
+	go syslog.conn.run()
+}
+
+// Stop waits for the pending messages to be delivered.
+// When the context is done first, pending messages are dropped.
+// Messages written afterwards are dropped and stopping again returns ErrStopped.
+func (syslog *Syslog) Stop(c context.Context) error {
+	syslog.once.Do(syslog.initialize)
+
+	err := syslog.busy.stop(c)
+	if err != ErrStopped && syslog.conn != nil {
+		syslog.conn.stop()
+	}
+
+	return err
+}
+
+// priority returns the priority of the messages of the metric.
+func (syslog *Syslog) priority(name string) int {
+	severity := syslog.severity
+	for _, pattern := range syslog.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			severity = syslog.Severities[pattern]
+			break
+		}
+	}
+
+	return syslog.facility*8 + severity
+}
+
+type syslogWriter struct {
+	syslog   *Syslog
+	dt       float64
+	time     string
+	messages [][]byte
+}
+
+func (w *syslogWriter) Write(name string, value float64) error {
+	return w.add(name, fmt.Sprintf("%f", value))
+}
+
+func (w *syslogWriter) WriteScaled(name string, value float64) error {
+	return w.add(name, fmt.Sprintf("%f", value/w.dt))
+}
+
+func (w *syslogWriter) WriteString(name, text string) error {
+	return w.add(name, text)
+}
+
+// add formats a message like '<134>1 2015-01-01T00:00:00.000000Z host app 42 metric [metric@32473 name="x" value="1.5"] x=1.5'.
+func (w *syslogWriter) add(name, value string) error {
+	s := w.syslog
+	priority := s.priority(name)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s metric [%s name=\"%s\" value=\"%s\"] %s=%s", priority, w.time, s.header, s.SDID, syslogEscape(name), syslogEscape(value), name, value)
+
+	message := b.Bytes()
+	if s.stream {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	w.messages = append(w.messages, message)
+	return nil
+}
+
+func (w *syslogWriter) Close() {
+	conn := w.syslog.conn
+	if conn == nil || len(w.messages) == 0 {
+		return
+	}
+
+	if !w.syslog.busy.add() {
+		HandleError(fmt.Errorf("syslog: dropping %d messages: %s", len(w.messages), ErrStopped))
+		return
+	}
+
+	go func() {
+		defer w.syslog.busy.done()
+
+		done := make(chan struct{})
+		ok := conn.deliver(func() {
+			// datagrams contain a single message
+			if w.syslog.stream {
+				conn.send(bytes.Join(w.messages, nil), len(w.messages))
+			} else {
+				for _, message := range w.messages {
+					conn.send(message, 1)
+				}
+			}
+
+			close(done)
+		})
+
+		if ok {
+			<-done
+		}
+	}()
+}
+
+// syslogEscape escapes the characters that are not allowed in the values of structured-data parameters.
+var syslogEscape = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`).Replace
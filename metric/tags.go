@@ -0,0 +1,75 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tagger extracts tags from the dotted keys of metrics for the reporters that support them.
+type Tagger struct {
+	// Tags contains tags added to every metric e.g. the host name.
+	Tags map[string]string
+	// Positions maps the name of a tag to the index of the segment of the key that contains its value.
+	// Negative indices count from the end of the key. The segments are removed from the name of the metric.
+	// For example, {"host": 1} splits 'app.web1.Requests' into 'app.Requests' with the tag 'host=web1'.
+	// Tags that don't fit in a key are skipped.
+	Positions map[string]int
+}
+
+// Split returns the name of the metric and its tags.
+// Extracted tags override the static tags with the same name.
+func (tagger *Tagger) Split(key string) (name string, tags map[string]string) {
+	tags = make(map[string]string, len(tagger.Tags)+len(tagger.Positions))
+	for k, v := range tagger.Tags {
+		tags[k] = v
+	}
+
+	if len(tagger.Positions) == 0 {
+		name = key
+		return
+	}
+
+	items := strings.Split(key, ".")
+	used := make([]bool, len(items))
+
+	for k, i := range tagger.Positions {
+		if i < 0 {
+			i += len(items)
+		}
+
+		if i < 0 || i >= len(items) {
+			continue
+		}
+
+		tags[k] = items[i]
+		used[i] = true
+	}
+
+	parts := make([]string, 0, len(items))
+	for i, item := range items {
+		if !used[i] {
+			parts = append(parts, item)
+		}
+	}
+
+	// keep the key when there is no segment left for the name
+	name = key
+	if len(parts) != 0 {
+		name = strings.Join(parts, ".")
+	}
+
+	return
+}
+
+// sortedTags returns the names of the tags in order.
+func sortedTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
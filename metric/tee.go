@@ -0,0 +1,246 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Tee implements a fan-out mechanism where every metric is written to all reporters.
+// For each specified reporter, an associated writer is created.
+// Errors are isolated: a failing writer doesn't prevent the others from receiving the metric.
+type Tee struct {
+	// Items contains the list of reporters.
+	Items []Reporter
+	// Async delivers the metrics to each reporter from its own background goroutine.
+	// When enabled, a slow reporter doesn't hold up the others or the caller.
+	Async bool
+	// Backlog contains the number of summaries that can be queued for each reporter in asynchronous mode.
+	// When the backlog of a reporter is full, the summary is dropped for that reporter.
+	// Will use 16 if 0.
+	Backlog int
+
+	once sync.Once
+	feed []chan func()
+	quit chan struct{}
+	busy deliveries
+}
+
+// NewTee returns a reporter that writes every metric to all the specified reporters.
+func NewTee(items ...Reporter) Reporter {
+	return &Tee{Items: items}
+}
+
+// NewWriter returns the writer that will duplicate metrics to every reporter.
+func (tee *Tee) NewWriter(s *Summary) Writer {
+	tee.once.Do(tee.initialize)
+
+	w := &teeWriter{tee: tee}
+	for _, item := range tee.Items {
+		if tee.Async {
+			w.list = append(w.list, &deferredWriter{reporter: item, summary: *s})
+			continue
+		}
+
+		w.list = append(w.list, item.NewWriter(s))
+	}
+
+	return w
+}
+
+func (tee *Tee) initialize() {
+	if !tee.Async {
+		return
+	}
+
+	n := tee.Backlog
+	if n == 0 {
+		n = 16
+	}
+
+	tee.quit = make(chan struct{})
+	tee.feed = make([]chan func(), len(tee.Items))
+	for i := range tee.Items {
+		feed := make(chan func(), n)
+		tee.feed[i] = feed
+		go tee.run(feed)
+	}
+}
+
+// run delivers the queued summaries of a reporter until the tee is stopped.
+func (tee *Tee) run(feed chan func()) {
+	for {
+		select {
+		case f := <-feed:
+			f()
+			tee.busy.done()
+		case <-tee.quit:
+			// release the summaries that will never be delivered
+			for {
+				select {
+				case <-feed:
+					tee.busy.done()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stop waits for the queued summaries to be delivered and stops every reporter.
+// It returns the first error encountered.
+// Summaries written afterwards are dropped and stopping again returns ErrStopped.
+func (tee *Tee) Stop(c context.Context) (err error) {
+	tee.once.Do(tee.initialize)
+
+	if err = tee.busy.stop(c); err == ErrStopped {
+		return
+	}
+
+	if tee.Async {
+		close(tee.quit)
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, item := range tee.Items {
+		if e := Stop(c, item); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+type teeWriter struct {
+	tee  *Tee
+	list []Writer
+}
+
+// forward invokes the function for every writer and isolates their errors.
+// It only reports ErrIgnored when all writers ignored the metric so that a tee can be used in a stack.
+func (tee *teeWriter) forward(name string, f func(w Writer) error) (err error) {
+	err = ErrIgnored
+	for i, w := range tee.list {
+		switch e := f(w); e {
+		case nil:
+			err = nil
+		case ErrIgnored:
+		default:
+			HandleError(fmt.Errorf("tee: reporter %d failed to write '%s': %s", i, name, e))
+			err = nil
+		}
+	}
+
+	return
+}
+
+func (tee *teeWriter) Write(name string, value float64) error {
+	return tee.forward(name, func(w Writer) error {
+		return w.Write(name, value)
+	})
+}
+
+func (tee *teeWriter) WriteScaled(name string, value float64) error {
+	return tee.forward(name, func(w Writer) error {
+		return w.WriteScaled(name, value)
+	})
+}
+
+func (tee *teeWriter) WriteString(name, text string) error {
+	return tee.forward(name, func(w Writer) error {
+		return w.WriteString(name, text)
+	})
+}
+
+func (tee *teeWriter) Close() {
+	if !tee.tee.Async {
+		for _, w := range tee.list {
+			w.Close()
+		}
+
+		return
+	}
+
+	for i, w := range tee.list {
+		d := w.(*deferredWriter)
+		if !tee.tee.busy.add() {
+			HandleError(fmt.Errorf("tee: dropping %d metrics of reporter %d: %s", len(d.items), i, ErrStopped))
+			continue
+		}
+
+		select {
+		case tee.tee.feed[i] <- d.replay:
+		default:
+			tee.tee.busy.done()
+			HandleError(fmt.Errorf("tee: backlog of reporter %d is full, dropping %d metrics", i, len(d.items)))
+		}
+	}
+}
+
+// deferredWriter records metrics so that they can be written later from another goroutine.
+// The writer of the reporter is only created on replay so that a dropped summary holds no resources.
+type deferredWriter struct {
+	reporter Reporter
+	summary  Summary
+	items    []deferredItem
+}
+
+type deferredItem struct {
+	kind  int
+	name  string
+	text  string
+	value float64
+}
+
+const (
+	deferredWrite = iota
+	deferredWriteScaled
+	deferredWriteString
+)
+
+func (w *deferredWriter) Write(name string, value float64) error {
+	w.items = append(w.items, deferredItem{kind: deferredWrite, name: name, value: value})
+	return nil
+}
+
+func (w *deferredWriter) WriteScaled(name string, value float64) error {
+	w.items = append(w.items, deferredItem{kind: deferredWriteScaled, name: name, value: value})
+	return nil
+}
+
+func (w *deferredWriter) WriteString(name, text string) error {
+	w.items = append(w.items, deferredItem{kind: deferredWriteString, name: name, text: text})
+	return nil
+}
+
+// Close does nothing since the metrics are written on replay.
+func (w *deferredWriter) Close() {
+}
+
+func (w *deferredWriter) replay() {
+	writer := w.reporter.NewWriter(&w.summary)
+	for _, item := range w.items {
+		var err error
+		switch item.kind {
+		case deferredWrite:
+			err = writer.Write(item.name, item.value)
+		case deferredWriteScaled:
+			err = writer.WriteScaled(item.name, item.value)
+		case deferredWriteString:
+			err = writer.WriteString(item.name, item.text)
+		}
+
+		if err != nil && err != ErrIgnored {
+			HandleError(fmt.Errorf("tee: failed to write '%s': %s", item.name, err))
+		}
+	}
+
+	writer.Close()
+}
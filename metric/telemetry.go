@@ -0,0 +1,154 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TelemetryPrefix contains the reserved prefix under which the library reports its own metrics.
+const TelemetryPrefix = "gometrics."
+
+// Telemetry accumulates the metrics of the library itself until they are recorded in a summary.
+type Telemetry struct {
+	mu       sync.Mutex
+	counts   map[string]float64
+	levels   map[string]float64
+	counters map[string]*TelemetryCounter
+}
+
+// TelemetryCounter contains a counter of the telemetry that is increased without locking e.g. on hot paths.
+type TelemetryCounter struct {
+	n int64
+}
+
+// Add increases the counter.
+func (c *TelemetryCounter) Add(n int64) {
+	atomic.AddInt64(&c.n, n)
+}
+
+// Self contains the telemetry of the library e.g. errors, Carbon connections or trace timelines.
+var Self = &Telemetry{}
+
+// Count increases a counter.
+func (t *Telemetry) Count(name string, value float64) {
+	t.mu.Lock()
+	if t.counts == nil {
+		t.counts = make(map[string]float64)
+	}
+
+	t.counts[name] += value
+	t.mu.Unlock()
+}
+
+// Counter returns the lock-free counter with the specified name.
+// Its value is moved into the summary by Record like the other counters.
+func (t *Telemetry) Counter(name string) *TelemetryCounter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.counters == nil {
+		t.counters = make(map[string]*TelemetryCounter)
+	}
+
+	c, ok := t.counters[name]
+	if !ok {
+		c = new(TelemetryCounter)
+		t.counters[name] = c
+	}
+
+	return c
+}
+
+// Set updates the level of a gauge.
+func (t *Telemetry) Set(name string, value float64) {
+	t.mu.Lock()
+	if t.levels == nil {
+		t.levels = make(map[string]float64)
+	}
+
+	t.levels[name] = value
+	t.mu.Unlock()
+}
+
+// Record moves the counters accumulated since the last call into the summary and updates its gauges.
+// Keys are created under TelemetryPrefix.
+// Since counters are moved, the telemetry should only be recorded in a single summary.
+func (t *Telemetry) Record(s *Summary) {
+	t.mu.Lock()
+	counts, levels := t.counts, make(map[string]float64, len(t.levels))
+	for name, value := range t.levels {
+		levels[name] = value
+	}
+
+	for name, c := range t.counters {
+		if n := atomic.SwapInt64(&c.n, 0); n != 0 {
+			if counts == nil {
+				counts = make(map[string]float64)
+			}
+
+			counts[name] += float64(n)
+		}
+	}
+
+	t.counts = nil
+	t.mu.Unlock()
+
+	for name, value := range counts {
+		s.Count(TelemetryPrefix+name, value)
+	}
+
+	for name, value := range levels {
+		s.Set(TelemetryPrefix+name, value)
+	}
+}
+
+// telemetryWriter counts the errors of a writer.
+type telemetryWriter struct {
+	Writer
+	errors int
+}
+
+func (w *telemetryWriter) check(err error) error {
+	if err != nil && err != ErrIgnored {
+		w.errors++
+	}
+
+	return err
+}
+
+func (w *telemetryWriter) Write(name string, value float64) error {
+	return w.check(w.Writer.Write(name, value))
+}
+
+func (w *telemetryWriter) WriteScaled(name string, value float64) error {
+	return w.check(w.Writer.WriteScaled(name, value))
+}
+
+func (w *telemetryWriter) WriteString(name, text string) error {
+	return w.check(w.Writer.WriteString(name, text))
+}
+
+// reporterName returns the name of the type of reporter e.g. 'Carbon'.
+func reporterName(r Reporter) string {
+	t := reflect.TypeOf(r)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Name()
+}
+
+// telemetryName converts an address into a valid key e.g. '127_0_0_1_2003'.
+func telemetryName(address string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "/", "_").Replace(address)
+}
+
+// since returns the number of seconds elapsed since the specified time according to the clock.
+func since(clock Clock, t time.Time) float64 {
+	return clockOf(clock).Now().Sub(t).Seconds()
+}
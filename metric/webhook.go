@@ -0,0 +1,273 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	"golang.org/x/net/context"
+)
+
+// WebhookSummary contains the metrics of a summary as posted by a webhook.
+// Rates are already scaled by the period.
+type WebhookSummary struct {
+	Name    string              `json:"name"`
+	Time    time.Time           `json:"time"`
+	Step    float64             `json:"step"`
+	Values  map[string]float64  `json:"values"`
+	Strings map[string][]string `json:"strings,omitempty"`
+}
+
+// Webhook POSTs batches of summaries to an URL.
+// The body is built from a template or is a JSON array of WebhookSummary.
+// Requests are sent in the background and retried on network errors, throttling or server errors.
+type Webhook struct {
+	// URL contains the address where batches are posted.
+	URL string
+	// Template is optional and builds the body from the batch as a []WebhookSummary.
+	Template *template.Template
+	// ContentType contains the type of the body. Will use 'application/json' if empty.
+	ContentType string
+	// Header contains additional headers sent with every request e.g. for authentication.
+	Header http.Header
+	// Secret is optional and signs the body with HMAC-SHA256.
+	// The signature is sent in the SignatureHeader as 'sha256=' followed by the hexadecimal digest.
+	Secret string
+	// SignatureHeader contains the name of the header with the signature. Will use 'X-Signature' if empty.
+	SignatureHeader string
+	// BatchSize contains the number of summaries per request. Will use 1 if 0.
+	// Incomplete batches are sent when the webhook is stopped.
+	BatchSize int
+	// Retries contains the number of attempts made to post a batch before dropping it. Will use 3 if 0.
+	Retries int
+	// Backoff contains the delay before the first retry and doubles after every attempt up to a minute. Will use 1s if 0.
+	Backoff time.Duration
+	// Timeout contains the time limit of every request when no client is specified. Will use 10s if 0.
+	Timeout time.Duration
+	// Client is optional and contains the HTTP client used to post batches.
+	Client *http.Client
+
+	once  sync.Once
+	mu    sync.Mutex
+	busy  deliveries
+	batch []*WebhookSummary
+	quit  chan struct{}
+}
+
+// NewWriter returns a writer that adds the summary to the current batch when it is closed.
+func (hook *Webhook) NewWriter(s *Summary) Writer {
+	hook.once.Do(hook.initialize)
+
+	return &webhookWriter{
+		hook: hook,
+		dt:   s.Step.Seconds(),
+		summary: &WebhookSummary{
+			Name:   s.Name,
+			Time:   s.Time,
+			Step:   s.Step.Seconds(),
+			Values: make(map[string]float64),
+		},
+	}
+}
+
+func (hook *Webhook) initialize() {
+	hook.ContentType = defaults.String(hook.ContentType, "application/json")
+	hook.SignatureHeader = defaults.String(hook.SignatureHeader, "X-Signature")
+	hook.Backoff = defaults.Duration(hook.Backoff, time.Second)
+	hook.quit = make(chan struct{})
+
+	if hook.Client == nil {
+		hook.Client = &http.Client{
+			Timeout: defaults.Duration(hook.Timeout, 10*time.Second),
+		}
+	}
+
+	if hook.BatchSize == 0 {
+		hook.BatchSize = 1
+	}
+
+	if hook.Retries == 0 {
+		hook.Retries = 3
+	}
+}
+
+// Stop sends the incomplete batch and waits for the pending batches to be posted.
+// When the context is done first, the remaining retries are aborted.
+// Summaries written afterwards are dropped and stopping again returns ErrStopped.
+func (hook *Webhook) Stop(c context.Context) error {
+	hook.once.Do(hook.initialize)
+
+	hook.mu.Lock()
+	batch := hook.batch
+	hook.batch = nil
+	hook.mu.Unlock()
+
+	if len(batch) != 0 {
+		hook.post(batch)
+	}
+
+	err := hook.busy.stop(c)
+	if err != ErrStopped {
+		close(hook.quit)
+	}
+
+	return err
+}
+
+// add queues the summary and posts the batch once it is complete.
+func (hook *Webhook) add(s *WebhookSummary) {
+	hook.mu.Lock()
+	hook.batch = append(hook.batch, s)
+
+	var batch []*WebhookSummary
+	if len(hook.batch) >= hook.BatchSize {
+		batch = hook.batch
+		hook.batch = nil
+	}
+	hook.mu.Unlock()
+
+	if batch != nil {
+		hook.post(batch)
+	}
+}
+
+// post sends the batch in the background.
+func (hook *Webhook) post(batch []*WebhookSummary) {
+	if !hook.busy.add() {
+		HandleError(fmt.Errorf("webhook: dropping %d summaries: %s", len(batch), ErrStopped))
+		return
+	}
+
+	go func() {
+		defer hook.busy.done()
+
+		body, err := hook.body(batch)
+		if err != nil {
+			HandleError(fmt.Errorf("webhook: %s", err))
+			return
+		}
+
+		if !hook.sendWithRetries(body) {
+			HandleError(fmt.Errorf("webhook: dropping %d summaries for '%s'", len(batch), hook.URL))
+			Self.Count("Webhook.Dropped", float64(len(batch)))
+			return
+		}
+
+		Self.Count("Webhook.Bytes", float64(len(body)))
+	}()
+}
+
+// body builds the payload of the batch.
+func (hook *Webhook) body(batch []*WebhookSummary) ([]byte, error) {
+	if hook.Template == nil {
+		return json.Marshal(batch)
+	}
+
+	var b bytes.Buffer
+	if err := hook.Template.Execute(&b, batch); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// sendWithRetries posts the body until it succeeds, fails permanently or the number of retries is exhausted.
+func (hook *Webhook) sendWithRetries(body []byte) bool {
+	backoff := Backoff{Delay: hook.Backoff, Attempts: hook.Retries}
+	return backoff.Retry(hook.quit, func(attempt int) (bool, error) {
+		retry, err := hook.send(body)
+		if err != nil {
+			HandleError(fmt.Errorf("webhook: %s", err))
+			Self.Count("Webhook.Errors", 1)
+		}
+
+		return retry, err
+	}) == nil
+}
+
+// send posts the body once and returns whether a failure can be retried.
+func (hook *Webhook) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	for key, values := range hook.Header {
+		req.Header[key] = values
+	}
+
+	req.Header.Set("Content-Type", hook.ContentType)
+
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set(hook.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	r, err := hook.Client.Do(req)
+	if err != nil {
+		retry = true
+		return
+	}
+
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		retry = true
+		return
+	}
+
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		retry = r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+		err = fmt.Errorf("unexpected status '%s' from '%s': %s", r.Status, hook.URL, bytes.TrimSpace(data))
+	}
+
+	return
+}
+
+type webhookWriter struct {
+	hook    *Webhook
+	dt      float64
+	summary *WebhookSummary
+}
+
+// Write rejects values that can't be encoded in JSON so that they don't prevent the batch from being posted.
+func (w *webhookWriter) Write(name string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("webhook: invalid value %f for '%s'", value, name)
+	}
+
+	w.summary.Values[name] = value
+	return nil
+}
+
+func (w *webhookWriter) WriteScaled(name string, value float64) error {
+	return w.Write(name, value/w.dt)
+}
+
+func (w *webhookWriter) WriteString(name, text string) error {
+	if w.summary.Strings == nil {
+		w.summary.Strings = make(map[string][]string)
+	}
+
+	w.summary.Strings[name] = append(w.summary.Strings[name], text)
+	return nil
+}
+
+func (w *webhookWriter) Close() {
+	w.hook.add(w.summary)
+}
@@ -3,11 +3,22 @@
 package metric
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	report "github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
 )
 
 type SomeMetrics struct {
@@ -89,9 +100,9 @@ func TestMetric(t *testing.T) {
 
 	values := map[string]string{
 		"Request":        `{"Count":2}`,
-		"Bytes":          `{"Average":289.5,"Maximum":456,"Minimum":123}`,
-		"Speed":          `{"Average":290.1225,"Maximum":456.789,"Minimum":123.456}`,
-		"Latency":        `{"Average":3e+06,"Maximum":4000000,"Minimum":2000000}`,
+		"Bytes":          `{"Average":289.5,"Maximum":456,"Minimum":123,"Count":2,"Sum":579,"Variance":27722.25,"StdDev":166.5}`,
+		"Speed":          `{"Average":290.1225,"Maximum":456.789,"Minimum":123.456,"Count":2,"Sum":580.245,"Variance":27777.722222249995,"StdDev":166.66649999999998}`,
+		"Latency":        `{"Average":3000000,"Maximum":4000000,"Minimum":2000000,"Count":2,"Sum":6000000,"Variance":1000000000000,"StdDev":1000000}`,
 		"Labels":         `{"Items":{"asdf":2}}`,
 		"Map":            `{"Items":{"a":{"Fail":{"Count":2}},"b":{"Fail":{"Count":0}},"c":{"Fail":{"Count":1}}}}`,
 		"Responses.Fail": `{"Count":1}`,
@@ -162,3 +173,371 @@ func BenchmarkMetric(b *testing.B) {
 		m.RecordMetrics("test", metric)
 	}
 }
+
+func TestStop(t *testing.T) {
+	m := Monitor{
+		Name:            "stop-test",
+		PublishInterval: time.Hour,
+	}
+
+	var result *Summary
+	m.PublishFunc(func(s *Summary) {
+		result = s
+	})
+
+	m.Start()
+	m.RecordMetrics("test", &SomeMetrics{Fail: true})
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := m.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if result == nil || result.Data["test"].Hits != 1 {
+		t.Fatalf("expecting the last period to be published on stop instead of %+v", result)
+	}
+
+	if err := m.Stop(c); err != ErrStopped {
+		t.Fatalf("expecting a second stop to fail instead of %v", err)
+	}
+
+	if err := (&Monitor{Name: "idle"}).Stop(c); err != ErrNotStarted {
+		t.Fatalf("expecting a stop before start to fail instead of %v", err)
+	}
+
+	carbon := &CarbonPublisher{}
+	if err := carbon.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := carbon.Stop(c); err != ErrStopped {
+		t.Fatalf("expecting a second stop of the publisher to fail instead of %v", err)
+	}
+}
+
+func TestCarbonPublisher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- string(data)
+	}()
+
+	var errors []error
+	report.SetErrorHandler(func(err error) {
+		errors = append(errors, err)
+	})
+
+	defer report.SetErrorHandler(nil)
+
+	// the summaries are sent before the publisher connects and dropped records are only written when there are some
+	carbon := &CarbonPublisher{URLs: []string{l.Addr().String()}}
+	carbon.Send(&Summary{Name: "test", Time: time.Unix(9, 0), Step: time.Second})
+	carbon.Send(&Summary{Name: "test", Time: time.Unix(10, 0), Step: time.Second, Dropped: 2})
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := carbon.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if text := <-received; text != "test.Dropped 2.000000 10\n" {
+		t.Fatalf("expecting the final summary to be flushed instead of %q", text)
+	}
+
+	carbon.Send(&Summary{Name: "test"})
+	if len(errors) != 1 || !strings.HasSuffix(errors[0].Error(), ErrStopped.Error()) {
+		t.Fatalf("expecting summaries sent after stop to be dropped instead of %v", errors)
+	}
+}
+
+func TestDropped(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest} {
+		m := Monitor{
+			Name:     "dropped-test",
+			Overflow: policy,
+			records:  make(chan metricSet, 1),
+			done:     make(chan struct{}),
+		}
+
+		m.RecordMetrics("first", &SomeMetrics{})
+		m.RecordMetrics("second", &SomeMetrics{})
+
+		if m.dropped != 1 {
+			t.Fatalf("expecting 1 dropped record instead of %d", m.dropped)
+		}
+
+		kept := "first"
+		if policy == DropOldest {
+			kept = "second"
+		}
+
+		if r := <-m.records; r.name != kept {
+			t.Fatalf("expecting '%s' to be kept instead of '%s'", kept, r.name)
+		}
+	}
+}
+
+type TaggedMetrics struct {
+	Latency time.Duration `metric:"RequestLatency,histogram"`
+	Bytes   int           `metric:",counter"`
+	Level   float64       `metric:"Load,gauge"`
+	Debug   string        `metric:"-"`
+	Host    string        `metric:",ignore"`
+	Wait    time.Duration `metric:",stats,percentiles"`
+}
+
+func TestTags(t *testing.T) {
+	s := &Summary{
+		Data: make(map[string]*Metrics),
+	}
+
+	for i := 1; i <= 2; i++ {
+		s.Record("test", &TaggedMetrics{
+			Latency: time.Duration(i) * time.Second,
+			Bytes:   i * 100,
+			Level:   float64(i),
+			Debug:   "debug",
+			Host:    "localhost",
+			Wait:    time.Duration(i) * time.Second,
+		})
+	}
+
+	values := map[string]string{
+		"RequestLatency": `{"Minimum":1,"Maximum":2,"Percentiles":{"50th":2,"90th":2,"99th":2}}`,
+		"Bytes":          `{"Total":300}`,
+		"Load":           `{"Value":2}`,
+		"Wait":           `{"Average":1500000000,"Maximum":2000000000,"Minimum":1000000000,"Count":2,"Sum":3000000000,"Variance":250000000000000000,"StdDev":500000000,"Percentiles":{"50th":2000000000,"90th":2000000000,"99th":2000000000}}`,
+	}
+
+	keys := s.Data["test"].Keys
+	if len(keys) != len(values) {
+		t.Fatalf("expecting %d keys instead of %d", len(values), len(keys))
+	}
+
+	for key, value := range values {
+		text, err := json.Marshal(keys[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(text) != value {
+			t.Fatalf("result should be '%s' instead of '%s'", value, text)
+		}
+	}
+}
+
+type Bytes int64
+
+type Status int
+
+func (s Status) String() string {
+	return [...]string{"ok", "fail"}[s]
+}
+
+type Window struct {
+	Values []float64
+}
+
+func (w *Window) RecordMetrics(keys map[string]Metric, name string) {
+	m, ok := keys[name+".Last"]
+	if !ok {
+		m = new(Gauge)
+		keys[name+".Last"] = m
+	}
+
+	m.Record(w.Values[len(w.Values)-1])
+}
+
+type WiderMetrics struct {
+	Size    Bytes
+	Count   uint32
+	Total   uint64
+	Ratio   float32
+	Status  Status
+	Missing *int
+	Present *int
+	Samples []int
+	Times   []time.Time
+	Names   [2]string
+	Window  Window
+	Empty   *Window
+	Codes   map[int]SomeMetrics
+	hidden  int
+}
+
+func TestWiderTypes(t *testing.T) {
+	s := &Summary{
+		Data: make(map[string]*Metrics),
+	}
+
+	n := 7
+	s.Record("test", &WiderMetrics{
+		Size:    1 << 40,
+		Count:   3,
+		Total:   math.MaxUint64,
+		Ratio:   0.5,
+		Status:  1,
+		Present: &n,
+		Samples: []int{1, 2, 3},
+		Times:   []time.Time{time.Unix(10, 0), time.Unix(20, 0)},
+		Names:   [2]string{"a", "b"},
+		Window:  Window{Values: []float64{1, 2}},
+		Codes:   map[int]SomeMetrics{404: {Fail: true}},
+	})
+
+	values := map[string]string{
+		"Size":        `{"Average":1099511627776,"Maximum":1099511627776,"Minimum":1099511627776,"Count":1,"Sum":1099511627776,"Variance":0,"StdDev":0}`,
+		"Count":       `{"Average":3,"Maximum":3,"Minimum":3,"Count":1,"Sum":3,"Variance":0,"StdDev":0}`,
+		"Total":       `{"Average":18446744073709552000,"Maximum":18446744073709552000,"Minimum":18446744073709552000,"Count":1,"Sum":18446744073709552000,"Variance":0,"StdDev":0}`,
+		"Ratio":       `{"Average":0.5,"Maximum":0.5,"Minimum":0.5,"Count":1,"Sum":0.5,"Variance":0,"StdDev":0}`,
+		"Status":      `{"Items":{"fail":1}}`,
+		"Present":     `{"Average":7,"Maximum":7,"Minimum":7,"Count":1,"Sum":7,"Variance":0,"StdDev":0}`,
+		"Samples":     `{"Minimum":1,"Maximum":3,"Percentiles":{"50th":2,"90th":3,"99th":3}}`,
+		"Times":       `{"Minimum":10,"Maximum":20,"Percentiles":{"50th":20,"90th":20,"99th":20}}`,
+		"Names":       `{"Items":{"a":1,"b":1}}`,
+		"Window.Last": `{"Value":2}`,
+		"Codes":       `{"Items":{"404":{"Fail":{"Count":1}}}}`,
+	}
+
+	keys := s.Data["test"].Keys
+	if len(keys) != len(values) {
+		t.Fatalf("expecting %d keys instead of %d", len(values), len(keys))
+	}
+
+	for key, value := range values {
+		text, err := json.Marshal(keys[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(text) != value {
+			t.Fatalf("result of '%s' should be '%s' instead of '%s'", key, value, text)
+		}
+	}
+}
+
+func TestReporterPublisher(t *testing.T) {
+	buffer := &bytes.Buffer{}
+
+	p := &ReporterPublisher{
+		Reporter: &report.Console{Writer: buffer},
+	}
+
+	p.Send(&Summary{
+		Name: "app",
+		Data: map[string]*Metrics{
+			"test": &Metrics{
+				Keys: map[string]Metric{
+					"Request": &Bool{Count: 4},
+					"Labels":  &String{Items: map[string]int{"a": 2}},
+				},
+			},
+		},
+		Time:    time.Unix(0, 0).UTC(),
+		Step:    2 * time.Second,
+		Dropped: 4,
+	})
+
+	for _, line := range []string{
+		"app.test.Request 2.000000",
+		"app.test.Labels.a 1.000000",
+		"app.Dropped 2.000000",
+	} {
+		if !strings.Contains(buffer.String(), line) {
+			t.Fatalf("missing '%s' in:\n%s", line, buffer.String())
+		}
+	}
+
+	// nothing is written for the dropped records unless there are some
+	buffer.Reset()
+	p.Send(&Summary{Name: "app", Step: time.Second})
+
+	if strings.Contains(buffer.String(), "Dropped") {
+		t.Fatalf("unexpected dropped records in:\n%s", buffer.String())
+	}
+}
+
+func TestJSONPublisher(t *testing.T) {
+	requests := make(chan map[string]interface{}, 2)
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "secret" {
+			t.Errorf("missing authorization header")
+		}
+
+		s := make(map[string]interface{})
+		if body, err := gzip.NewReader(r.Body); err != nil {
+			t.Error(err)
+		} else if err := json.NewDecoder(body).Decode(&s); err != nil {
+			t.Error(err)
+		}
+
+		requests <- s
+	}))
+
+	defer server.Close()
+
+	p := &JSONPublisher{
+		URL:     server.URL,
+		Header:  http.Header{"Authorization": []string{"secret"}},
+		Gzip:    true,
+		Backoff: time.Millisecond,
+	}
+
+	p.Send(&Summary{Name: "json-test"})
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := p.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-requests
+	if s["Name"] != "json-test" || attempts != 2 {
+		t.Fatalf("expecting the summary after a retry instead of %+v after %d attempts", s, attempts)
+	}
+
+	if err := p.Stop(c); err != ErrStopped {
+		t.Fatalf("expecting a second stop to fail instead of %v", err)
+	}
+
+	// the retries are aborted by an expired context
+	p = &JSONPublisher{URL: "http://127.0.0.1:1", Backoff: time.Minute}
+	p.Send(&Summary{Name: "json-test"})
+
+	expired, abort := context.WithCancel(context.Background())
+	abort()
+
+	if err := p.Stop(expired); err != context.Canceled {
+		t.Fatalf("expecting the stop to be aborted instead of %v", err)
+	}
+
+	if err := p.Stop(expired); err != ErrStopped {
+		t.Fatalf("expecting a second stop to fail instead of %v", err)
+	}
+}
@@ -3,12 +3,16 @@
 package metric
 
 import (
-	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
 	"log"
-	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/datacratic/gometrics/defaults"
+	report "github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
 )
 
 // Publisher defines an interface where the summary of metrics can be published.
@@ -24,9 +28,32 @@ func (fn PublisherFunc) Send(s *Summary) {
 	fn(s)
 }
 
+// ErrStopped is returned when a monitor or a publisher is stopped more than once.
+// It is the same error as the one returned by the reporters.
+var ErrStopped = report.ErrStopped
+
+// ErrNotStarted is returned when a monitor is stopped before being started.
+var ErrNotStarted = errors.New("metric: not started")
+
 // DefaultMetricPublishInterval defines the default frequency used to publish the summary of metrics.
 var DefaultMetricPublishInterval = time.Second
 
+// DefaultQueueSize defines the default number of records that can be queued before being aggregated.
+var DefaultQueueSize = 1024
+
+// OverflowPolicy defines what happens to records posted while the queue of the monitor is full.
+type OverflowPolicy int
+
+// Policies available when the queue of the monitor is full.
+const (
+	// Block waits until there is room in the queue.
+	Block OverflowPolicy = iota
+	// DropNewest drops the record being posted.
+	DropNewest
+	// DropOldest drops the oldest queued record to make room for the one being posted.
+	DropOldest
+)
+
 // Monitor implements a service where metrics can be posted.
 type Monitor struct {
 	// Name contains an friendly identifier for this set of metrics.
@@ -35,9 +62,18 @@ type Monitor struct {
 	Publisher Publisher
 	// PublishInterval contains the frequency of publication. Will use DefaultMetricPublishInterval if 0.
 	PublishInterval time.Duration
+	// QueueSize contains the number of records that can be queued. Will use DefaultQueueSize if 0.
+	QueueSize int
+	// Overflow contains the policy used when the queue is full.
+	// Dropped records are counted in the summary.
+	Overflow OverflowPolicy
 
 	summary *Summary
+	dropped int64
 	records chan metricSet
+	quit    chan struct{}
+	done    chan struct{}
+	stop    sync.Once
 }
 
 type metricSet struct {
@@ -52,14 +88,16 @@ func (monitor *Monitor) Run() {
 // Start creates the background service that aggregate metrics and publish them periodically.
 func (monitor *Monitor) Start() {
 	if monitor.Name == "" {
-		log.Panic("Name must be set for monitor")
+		report.HandleError(errors.New("metric: name must be set for monitor"))
+		monitor.Name = defaults.Name()
 	}
 
 	if monitor.Publisher == nil {
 		monitor.PublishFunc(func(s *Summary) {
 			text, err := json.MarshalIndent(s, "", "\t")
 			if err != nil {
-				log.Panic(err)
+				report.HandleError(err)
+				return
 			}
 
 			log.Println(string(text))
@@ -75,32 +113,40 @@ func (monitor *Monitor) Start() {
 		monitor.PublishInterval = DefaultMetricPublishInterval
 	}
 
-	monitor.records = make(chan metricSet)
+	if monitor.QueueSize == 0 {
+		monitor.QueueSize = DefaultQueueSize
+	}
+
+	monitor.records = make(chan metricSet, monitor.QueueSize)
+	monitor.quit = make(chan struct{})
+	monitor.done = make(chan struct{})
 
 	// start the background service
 	go func() {
 		t := time.NewTicker(monitor.PublishInterval)
+		defer t.Stop()
+
+		last := time.Now()
 		for {
 			select {
 			case r := <-monitor.records:
 				monitor.summary.Record(r.name, r.data)
 
-			case <-t.C:
-				if len(monitor.summary.Data) == 0 {
-					break
-				}
+			case now := <-t.C:
+				monitor.publish(now, monitor.PublishInterval)
+				last = now
 
-				s := monitor.summary
-				s.Time = time.Now()
-				s.Step = monitor.PublishInterval
-				s.Send++
-				monitor.summary = &Summary{
-					Name: s.Name,
-					Data: make(map[string]*Metrics),
-					Send: s.Send,
+			case <-monitor.quit:
+				// aggregate the records still queued
+				for n := len(monitor.records); n > 0; n-- {
+					r := <-monitor.records
+					monitor.summary.Record(r.name, r.data)
 				}
 
-				monitor.Publisher.Send(s)
+				now := time.Now()
+				monitor.publish(now, now.Sub(last))
+				close(monitor.done)
+				return
 			}
 		}
 	}()
@@ -108,11 +154,96 @@ func (monitor *Monitor) Start() {
 	return
 }
 
+// publish sends the current summary to the publisher unless it is empty.
+func (monitor *Monitor) publish(now time.Time, step time.Duration) {
+	dropped := atomic.SwapInt64(&monitor.dropped, 0)
+	if len(monitor.summary.Data) == 0 && dropped == 0 {
+		return
+	}
+
+	s := monitor.summary
+	s.Dropped = int(dropped)
+	s.Time = now
+	s.Step = step
+	s.Send++
+	monitor.summary = &Summary{
+		Name: s.Name,
+		Data: make(map[string]*Metrics),
+		Send: s.Send,
+	}
+
+	monitor.Publisher.Send(s)
+}
+
+// Stop ends the background service after publishing the metrics of the current period.
+// If the publisher implements a Stop method, it is then used to wait for the delivery of the summary.
+// Stop returns when everything is flushed or when the context is done.
+// Metrics recorded afterwards are ignored.
+// Stopping a monitor that isn't started or more than once returns an error.
+func (monitor *Monitor) Stop(c context.Context) error {
+	if monitor.quit == nil {
+		return ErrNotStarted
+	}
+
+	stopped := false
+	monitor.stop.Do(func() {
+		close(monitor.quit)
+		stopped = true
+	})
+
+	if !stopped {
+		return ErrStopped
+	}
+
+	select {
+	case <-monitor.done:
+	case <-c.Done():
+		return c.Err()
+	}
+
+	if p, ok := monitor.Publisher.(interface {
+		Stop(context.Context) error
+	}); ok {
+		return p.Stop(c)
+	}
+
+	return nil
+}
+
 // RecordMetrics posts a set of metrics to the monitor background service.
+// When the queue is full, the record is handled according to the overflow policy.
 func (monitor *Monitor) RecordMetrics(name string, data interface{}) {
-	monitor.records <- metricSet{
-		name: name,
-		data: data,
+	r := metricSet{name: name, data: data}
+
+	switch monitor.Overflow {
+	case DropNewest:
+		select {
+		case monitor.records <- r:
+		case <-monitor.done:
+		default:
+			atomic.AddInt64(&monitor.dropped, 1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case monitor.records <- r:
+				return
+			case <-monitor.done:
+				return
+			default:
+			}
+
+			select {
+			case <-monitor.records:
+				atomic.AddInt64(&monitor.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case monitor.records <- r:
+		case <-monitor.done:
+		}
 	}
 }
 
@@ -138,27 +269,11 @@ func (monitor *Monitor) PublishFunc(handler func(*Summary)) {
 func NewJSONMonitor(name string, url string) (monitor *Monitor) {
 	monitor = &Monitor{
 		Name: name,
+		Publisher: &JSONPublisher{
+			URL: url,
+		},
 	}
 
-	monitor.PublishFunc(func(s *Summary) {
-		text, err := json.Marshal(s)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		r, err := http.Post(url, "application/json", bytes.NewReader(text))
-		if err != nil {
-			log.Panic(err)
-		}
-
-		_, err = ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		r.Body.Close()
-	})
-
 	monitor.Start()
 	return
 }
@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package metric
+
+import (
+	"strings"
+
+	report "github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
+)
+
+// ReporterPublisher publishes the summary of metrics through any reporter of the metric sub-package.
+// Booleans, counters and strings are written as rates while other numerical metrics are written with their statistics.
+// Maps are written recursively.
+type ReporterPublisher struct {
+	// Reporter receives the metrics of every published summary.
+	Reporter report.Reporter
+}
+
+// NewReporterMonitor creates a monitor that writes the summary of metrics to the specified reporter.
+func NewReporterMonitor(name string, r report.Reporter) (monitor *Monitor) {
+	monitor = &Monitor{
+		Name: name,
+		Publisher: &ReporterPublisher{
+			Reporter: r,
+		},
+	}
+
+	return
+}
+
+// Send writes the summary of metrics to a new writer of the reporter.
+func (p *ReporterPublisher) Send(s *Summary) {
+	w := p.Reporter.NewWriter(&report.Summary{
+		Name: s.Name,
+		Time: s.Time,
+		Step: s.Step,
+	})
+
+	path := s.Name
+	if path != "" && !strings.HasSuffix(path, ".") {
+		path += "."
+	}
+
+	for name, metrics := range s.Data {
+		writeToReporter(w, metrics.Keys, path+name)
+	}
+
+	if s.Dropped != 0 {
+		w.WriteScaled(path+"Dropped", float64(s.Dropped))
+	}
+
+	w.Close()
+}
+
+// Stop stops the reporter.
+func (p *ReporterPublisher) Stop(c context.Context) error {
+	return report.Stop(c, p.Reporter)
+}
+
+func writeToReporter(w report.Writer, metrics map[string]Metric, name string) {
+	for key, metric := range metrics {
+		text := name + "." + key
+		switch m := metric.(type) {
+		case *Bool:
+			w.WriteScaled(text, float64(m.Count))
+		case statistics:
+			st := m.statistics()
+			w.Write(text+".Average", st.Average)
+			w.Write(text+".Maximum", st.Maximum)
+			w.Write(text+".Minimum", st.Minimum)
+			w.WriteScaled(text+".Count", st.Count)
+			w.WriteScaled(text+".Sum", st.Sum)
+			w.Write(text+".Variance", st.Variance)
+			w.Write(text+".StdDev", st.StdDev)
+			for key, value := range st.Percentiles {
+				w.Write(text+"."+key, value)
+			}
+		case *Counter:
+			w.WriteScaled(text, m.Total)
+		case *Gauge:
+			w.Write(text, m.Value)
+		case *Histogram:
+			w.Write(text+".Minimum", m.Minimum)
+			w.Write(text+".Maximum", m.Maximum)
+			for key, value := range m.Percentiles() {
+				w.Write(text+"."+key, value)
+			}
+		case *String:
+			for key, value := range m.Items {
+				w.WriteScaled(text+"."+key, float64(value))
+			}
+		case *Map:
+			for key, value := range m.Items {
+				writeToReporter(w, value, text+"."+key)
+			}
+		}
+	}
+}
@@ -3,8 +3,12 @@
 package metric
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"time"
+
+	report "github.com/datacratic/gometrics/metric"
 )
 
 // Metrics represents the aggregation of a set of metrics over a period of time.
@@ -27,10 +31,18 @@ type Summary struct {
 	Time time.Time
 	// Step contains the duration of the aggreation period.
 	Step time.Duration
+	// Dropped contains the number of records dropped by the monitor because its queue was full.
+	Dropped int
 }
 
 // Record uses reflection to create and aggregate metrics based on their data type.
 func (summary *Summary) Record(name string, data interface{}) {
+	value, ok := indirect(reflect.ValueOf(data))
+	if !ok || value.Kind() != reflect.Struct {
+		report.HandleError(fmt.Errorf("metric: cannot record metrics of type %T for '%s'", data, name))
+		return
+	}
+
 	item, ok := summary.Data[name]
 	if !ok {
 		item = new(Metrics)
@@ -39,54 +51,266 @@ func (summary *Summary) Record(name string, data interface{}) {
 	}
 
 	item.Hits++
-	recordMembers(reflect.ValueOf(data).Elem(), item.Keys, "")
+	recordMembers(value, item.Keys, "")
+}
+
+// parseTag returns the name and the kind of metric specified by the 'metric' tag of a field.
+// The tag has the form `metric:"name,kind,percentiles"` where every part is optional.
+// The name defaults to the name of the field and a name of '-' skips the field.
+// The 'percentiles' option enables the estimation of percentiles for the 'stats' kind.
+func parseTag(f reflect.StructField) (name, kind string, percentiles bool) {
+	name = f.Name
+
+	tag := f.Tag.Get("metric")
+	if tag == "" {
+		return
+	}
+
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" {
+		name = parts[0]
+	}
+
+	for _, part := range parts[1:] {
+		if part == "percentiles" {
+			percentiles = true
+		} else {
+			kind = part
+		}
+	}
+
+	return
+}
+
+// newMetric creates the metric for the data based on its type and the kind specified by its tag.
+// Numerical and boolean values support the 'counter', 'gauge' and 'histogram' kinds.
+// Integer, floating point and duration values also support the 'stats' kind which is their default.
+// String values support the 'count' kind which is their default.
+// Any value can be skipped with the 'ignore' kind.
+func newMetric(data interface{}, kind string, percentiles bool) Metric {
+	switch data.(type) {
+	case bool, int, float64, time.Duration:
+		switch kind {
+		case "counter":
+			return new(Counter)
+		case "gauge":
+			return new(Gauge)
+		case "histogram":
+			return new(Histogram)
+		}
+	}
+
+	var r *Reservoir
+	if percentiles {
+		r = new(Reservoir)
+	}
+
+	switch data.(type) {
+	case bool:
+		return new(Bool)
+	case int:
+		return &Int{Percentiles: r}
+	case float64:
+		return &Float{Percentiles: r}
+	case time.Duration:
+		return &Duration{Percentiles: r}
+	case string:
+		return &String{
+			Items: make(map[string]int),
+		}
+	}
+
+	return nil
+}
+
+// MetricRecorder is implemented by types that record their own metrics.
+// RecordMetrics is invoked instead of inspecting the members of the value.
+// The name is the key of the value and should be used as a prefix for the keys it creates.
+type MetricRecorder interface {
+	RecordMetrics(keys map[string]Metric, name string)
+}
+
+// scalar converts the value to one of the basic types supported by metrics.
+// Integers of any size become 'int' except unsigned 64-bit integers which become 'float64' to avoid overflows.
+// Floating points become 'float64'.
+// Times become a 'float64' number of seconds since the Unix epoch and are skipped when zero.
+// Values of other types implementing fmt.Stringer become a 'string'.
+// It returns false if the value isn't a scalar and nil if a scalar should be skipped.
+func scalar(v reflect.Value) (interface{}, bool) {
+	switch item := v.Interface().(type) {
+	case time.Duration:
+		return item, true
+	case time.Time:
+		if item.IsZero() {
+			return nil, true
+		}
+
+		return float64(item.UnixNano()) / float64(time.Second), true
+	case fmt.Stringer:
+		if v.Kind() != reflect.Struct {
+			return item.String(), true
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int()), true
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int(v.Uint()), true
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		return v.String(), true
+	}
+
+	return nil, false
+}
+
+// sample returns a value of the scalar type recorded for elements of the type or nil if they aren't scalars.
+func sample(t reflect.Type) interface{} {
+	// the zero time is skipped by scalar but times are recorded as seconds
+	if t == reflect.TypeOf(time.Time{}) {
+		return float64(0)
+	}
+
+	item, _ := scalar(reflect.Zero(t))
+	return item
+}
+
+// recorder returns the value as a MetricRecorder if it or its address implements the interface.
+func recorder(v reflect.Value) (MetricRecorder, bool) {
+	if r, ok := v.Interface().(MetricRecorder); ok {
+		return r, true
+	}
+
+	if v.CanAddr() {
+		if r, ok := v.Addr().Interface().(MetricRecorder); ok {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// indirect follows pointers and interfaces.
+// It returns false when a nil pointer or interface is found.
+func indirect(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+
+		v = v.Elem()
+	}
+
+	return v, true
 }
 
 func recordMembers(value reflect.Value, keys map[string]Metric, prefix string) {
-	t := value.Type()
+	value, ok := indirect(value)
+	if !ok {
+		return
+	}
 
-	if t.Kind() == reflect.Ptr {
-		recordMembers(value.Elem(), keys, prefix)
+	t := value.Type()
+	if t.Kind() != reflect.Struct {
+		report.HandleError(fmt.Errorf("metric: cannot record members of type %s", t))
 		return
 	}
 
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
 		v := value.Field(i)
+
+		// skip unexported members
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, kind, percentiles := parseTag(f)
+		if name == "-" || kind == "ignore" {
+			continue
+		}
+
+		// nil pointers and interfaces have nothing to record even when their type is a recorder
+		if k := v.Kind(); (k == reflect.Ptr || k == reflect.Interface) && v.IsNil() {
+			continue
+		}
+
+		if r, ok := recorder(v); ok {
+			r.RecordMetrics(keys, prefix+name)
+			continue
+		}
+
+		v, ok := indirect(v)
+		if !ok {
+			continue
+		}
+
 		k := v.Kind()
 
-		m, ok := keys[prefix+f.Name]
+		data, isScalar := scalar(v)
+		if isScalar && data == nil {
+			continue
+		}
+
+		m, ok := keys[prefix+name]
 		if !ok {
-			switch v.Interface().(type) {
-			case bool:
-				m = new(Bool)
-			case int:
-				m = new(Int)
-			case float64:
-				m = new(Float)
-			case time.Duration:
-				m = new(Duration)
-			case string:
-				m = &String{
-					Items: make(map[string]int),
+			switch {
+			case isScalar:
+				m = newMetric(data, kind, percentiles)
+			case k == reflect.Slice || k == reflect.Array:
+				// sequences of numbers default to an histogram while strings are counted
+				e := v.Type().Elem()
+				for e.Kind() == reflect.Ptr {
+					e = e.Elem()
 				}
-			default:
-				switch {
-				case k == reflect.Map:
-					m = &Map{
-						Items: make(map[string]map[string]Metric),
-					}
-				case k == reflect.Struct:
-					recordMembers(v, keys, f.Name+".")
-					continue
-				default:
-					continue
+
+				item := sample(e)
+				if _, ok := item.(string); !ok && kind == "" {
+					kind = "histogram"
 				}
+
+				if item != nil {
+					m = newMetric(item, kind, percentiles)
+				}
+			case k == reflect.Map:
+				m = &Map{
+					Items: make(map[string]map[string]Metric),
+				}
+			case k == reflect.Struct:
+				recordMembers(v, keys, prefix+name+".")
+				continue
 			}
 
-			keys[prefix+f.Name] = m
+			if m == nil {
+				continue
+			}
+
+			keys[prefix+name] = m
 		}
 
-		m.Record(v.Interface())
+		switch {
+		case isScalar:
+			m.Record(data)
+		case k == reflect.Slice || k == reflect.Array:
+			// record each element of the sequence
+			for j, n := 0, v.Len(); j < n; j++ {
+				item, ok := indirect(v.Index(j))
+				if !ok {
+					continue
+				}
+
+				if data, ok := scalar(item); ok && data != nil {
+					m.Record(data)
+				}
+			}
+		default:
+			m.Record(v.Interface())
+		}
 	}
 }
@@ -0,0 +1,39 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package trace
+
+import (
+	"time"
+
+	"github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
+)
+
+// clockKey is a private type to find the current clock.
+type clockKey int
+
+// SetClock installs a clock in a new context.
+// Timelines started from that context use the clock to time their events.
+func SetClock(c context.Context, clock metric.Clock) context.Context {
+	return context.WithValue(c, clockKey(0), clock)
+}
+
+// clockOf returns the clock installed in the context.
+func clockOf(c context.Context) metric.Clock {
+	clock, _ := c.Value(clockKey(0)).(metric.Clock)
+	return orDefault(clock)
+}
+
+// orDefault returns the clock or the default clock when nil.
+func orDefault(clock metric.Clock) metric.Clock {
+	if clock == nil {
+		return metric.DefaultClock
+	}
+
+	return clock
+}
+
+// now returns the current time of the clock or of the default clock when nil.
+func now(clock metric.Clock) time.Time {
+	return orDefault(clock).Now()
+}
@@ -3,16 +3,24 @@
 package trace
 
 import (
-	"log"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/datacratic/gometrics/metric"
 	"golang.org/x/net/context"
 )
 
 const HeaderKey = "Trace-Key"
 
+// telemetry counters updated on every trace without locking
+var (
+	tracePooled    = metric.Self.Counter("Trace.Pooled")
+	traceAllocated = metric.Self.Counter("Trace.Allocated")
+	traceLate      = metric.Self.Counter("Trace.Late")
+)
+
 type Pool struct {
 	pool chan interface{}
 	New  func() interface{}
@@ -51,7 +59,9 @@ type timeline struct {
 	mu    sync.Mutex
 	queue []Event
 
-	tracing string
+	tracing  string
+	clock    metric.Clock
+	recycled bool
 	Handler
 }
 
@@ -112,7 +122,14 @@ func create(c context.Context, name, tracing string, kind int) context.Context {
 
 		// get the timeline storage from the pool
 		t := timelines.Get().(*timeline)
-		t.begin = time.Now()
+		if t.recycled {
+			tracePooled.Add(1)
+		} else {
+			traceAllocated.Add(1)
+		}
+
+		t.clock = clockOf(c)
+		t.begin = t.clock.Now()
 		t.count = 0
 		t.Handler = handler
 		t.tracing = tracing
@@ -132,6 +149,7 @@ func create(c context.Context, name, tracing string, kind int) context.Context {
 	// ignore?
 	if s.epoch != t.epoch {
 		t.mu.Unlock()
+		traceLate.Add(1)
 		return c
 	}
 
@@ -156,7 +174,8 @@ func create(c context.Context, name, tracing string, kind int) context.Context {
 func Leave(c context.Context, name string) {
 	s, ok := c.Value(spanKey(0)).(*span)
 	if !ok {
-		log.Panic("no span", name)
+		metric.HandleError(fmt.Errorf("trace: no span to leave with '%s'", name))
+		return
 	}
 
 	t := s.owner
@@ -167,15 +186,18 @@ func Leave(c context.Context, name string) {
 	// ignore?
 	if s.epoch != t.epoch {
 		t.mu.Unlock()
+		traceLate.Add(1)
 		return
 	}
 
 	if s.done != 0 {
-		log.Panic("span was already left")
-	} else {
-		s.done++
+		t.mu.Unlock()
+		metric.HandleError(fmt.Errorf("trace: span was already left with '%s'", name))
+		return
 	}
 
+	s.done++
+
 	// record
 	t.add(s.id, LeaveEvent, name, nil)
 
@@ -187,6 +209,7 @@ func Leave(c context.Context, name string) {
 		h := chainHandler{
 			Handler: t.Handler,
 			f: func() {
+				t.recycled = true
 				timelines.Put(t)
 			},
 		}
@@ -227,7 +250,8 @@ func Log(c context.Context, name string, data ...string) {
 func store(c context.Context, name string, data interface{}, kind int) {
 	s, ok := c.Value(spanKey(0)).(*span)
 	if !ok {
-		log.Panic("no span")
+		metric.HandleError(fmt.Errorf("trace: no span to store '%s'", name))
+		return
 	}
 
 	t := s.owner
@@ -238,6 +262,7 @@ func store(c context.Context, name string, data interface{}, kind int) {
 	// ignore?
 	if s.epoch != t.epoch {
 		t.mu.Unlock()
+		traceLate.Add(1)
 		return
 	}
 
@@ -269,7 +294,7 @@ func (t *timeline) add(from int64, kind int, what string, data interface{}) int6
 	item := &t.queue[i]
 	item.From = from
 	item.Kind = kind
-	item.When = time.Since(t.begin)
+	item.When = t.clock.Now().Sub(t.begin)
 	item.What = what
 	item.Path = ""
 	item.Data = data
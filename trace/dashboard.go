@@ -0,0 +1,278 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/datacratic/gometrics/metric"
+)
+
+// Dashboard serves a self-contained HTML page with the recent metrics of the process and the call graph of its traces.
+// Every key of the history is shown with a sparkline while the percentiles of histograms are grouped in a single chart.
+// It is usually installed next to the other debug handlers:
+//
+//	http.Handle("/debug/metrics", &trace.Dashboard{History: history, Graph: graph})
+//
+// The 'match' parameter filters keys with a glob pattern.
+type Dashboard struct {
+	// History contains the recent metrics e.g. added to the reporters of the Metrics handler.
+	History *metric.History
+	// Graph is optional and contains the call graph of traces.
+	// It is drawn in SVG when the dot command is available and in DOT format otherwise.
+	// The drawing is kept for the refresh period so that open pages don't run the dot command on every reload.
+	Graph *Graph
+	// Window contains the time range shown by sparklines. Will use 1h if 0.
+	Window time.Duration
+	// Refresh contains the period at which the page reloads itself. Will use 10s if 0.
+	Refresh time.Duration
+	// Clock provides the current time that ends the window.
+	// Will use the clock of the history or metric.DefaultClock if nil.
+	Clock metric.Clock
+
+	mu    sync.Mutex
+	graph template.HTML
+	drawn time.Time
+}
+
+// dashboardChart contains the lines of a chart.
+type dashboardChart struct {
+	Name  string
+	Lines []dashboardLine
+}
+
+type dashboardLine struct {
+	Name   string
+	Last   float64
+	Points []metric.Point
+}
+
+// percentileKey matches the keys of histogram percentiles e.g. 'Request.Latency.99th'.
+var percentileKey = regexp.MustCompile(`^(.*)\.([0-9.]+th)$`)
+
+// dashboardColors contains the colors of the lines of a chart.
+var dashboardColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd"}
+
+// ServeHTTP renders the dashboard.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	window := d.Window
+	if window == 0 {
+		window = time.Hour
+	}
+
+	refresh := d.Refresh
+	if refresh == 0 {
+		refresh = 10 * time.Second
+	}
+
+	match := r.URL.Query().Get("match")
+	if match == "" {
+		match = "*"
+	}
+
+	clock := d.Clock
+	if clock == nil && d.History != nil {
+		clock = d.History.Clock
+	}
+
+	now := orDefault(clock).Now()
+
+	var charts []*dashboardChart
+	if d.History != nil {
+		charts = dashboardCharts(d.History.Query(match, now.Add(-window), now, 0))
+	}
+
+	data := map[string]interface{}{
+		"Refresh": int(refresh.Seconds()),
+		"Match":   match,
+		"Window":  window,
+		"Charts":  charts,
+		"Graph":   d.draw(now, refresh),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPage.Execute(w, data); err != nil {
+		metric.HandleError(fmt.Errorf("trace: %s", err))
+	}
+}
+
+// draw returns the drawing of the call graph and only draws it again once it is older than the refresh period.
+func (d *Dashboard) draw(now time.Time, refresh time.Duration) template.HTML {
+	if d.Graph == nil {
+		return ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.drawn.IsZero() && now.Sub(d.drawn) < refresh {
+		return d.graph
+	}
+
+	d.graph = ""
+	if svg, err := d.Graph.DrawSVG(); err == nil {
+		d.graph = template.HTML(svg)
+	} else if dot, err := d.Graph.DrawDOT(); err == nil {
+		d.graph = template.HTML("<pre>" + template.HTMLEscapeString(string(dot)) + "</pre>")
+	}
+
+	d.drawn = now
+	return d.graph
+}
+
+// dashboardCharts groups the percentiles of histograms and sorts the charts by name.
+func dashboardCharts(series map[string][]metric.Point) (charts []*dashboardChart) {
+	groups := make(map[string]*dashboardChart)
+
+	for key, points := range series {
+		name, line := key, key
+		if m := percentileKey.FindStringSubmatch(key); m != nil {
+			name, line = m[1], m[2]
+		}
+
+		chart, ok := groups[name]
+		if !ok {
+			chart = &dashboardChart{Name: name}
+			groups[name] = chart
+			charts = append(charts, chart)
+		}
+
+		chart.Lines = append(chart.Lines, dashboardLine{
+			Name:   line,
+			Last:   points[len(points)-1].Value,
+			Points: points,
+		})
+	}
+
+	for _, chart := range charts {
+		sort.Sort(linesByPercentile(chart.Lines))
+	}
+
+	sort.Sort(chartsByName(charts))
+	return
+}
+
+type chartsByName []*dashboardChart
+
+func (c chartsByName) Len() int           { return len(c) }
+func (c chartsByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c chartsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// linesByPercentile sorts percentiles numerically e.g. 9th before 50th.
+type linesByPercentile []dashboardLine
+
+func (l linesByPercentile) Len() int      { return len(l) }
+func (l linesByPercentile) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l linesByPercentile) Less(i, j int) bool {
+	if len(l[i].Name) != len(l[j].Name) {
+		return len(l[i].Name) < len(l[j].Name)
+	}
+
+	return l[i].Name < l[j].Name
+}
+
+// sparkline draws the lines of a chart as an inline SVG.
+func sparkline(lines []dashboardLine) template.HTML {
+	const width, height = 240.0, 32.0
+
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, line := range lines {
+		for _, p := range line.Points {
+			t := p.Time.UnixNano()
+			first, last = minInt64(first, t), maxInt64(last, t)
+			low, high = math.Min(low, p.Value), math.Max(high, p.Value)
+		}
+	}
+
+	dt, dv := float64(last-first), high-low
+	if dt == 0 {
+		dt = 1
+	}
+
+	if dv == 0 || math.IsInf(dv, 0) || math.IsNaN(dv) {
+		dv = 1
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f">`, width, height, width, height)
+	for i, line := range lines {
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="`, dashboardColors[i%len(dashboardColors)])
+		for _, p := range line.Points {
+			x := float64(p.Time.UnixNano()-first) / dt * width
+			y := height - 1 - (p.Value-low)/dv*(height-2)
+			if math.IsNaN(y) || math.IsInf(y, 0) {
+				continue
+			}
+
+			fmt.Fprintf(&b, "%.1f,%.1f ", x, y)
+		}
+
+		b.WriteString(`"/>`)
+	}
+
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"sparkline": sparkline,
+	"color": func(i int) template.CSS {
+		return template.CSS(dashboardColors[i%len(dashboardColors)])
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Metrics</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 16px; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 12px 2px 0; text-align: left; vertical-align: middle; }
+td.value { text-align: right; font-family: monospace; }
+tr:hover { background: #f4f4f4; }
+</style>
+</head>
+<body>
+<form method="get">
+<input name="match" value="{{.Match}}" size="40"> <input type="submit" value="Filter"> last {{.Window}}
+</form>
+<h2>Metrics</h2>
+<table>
+<tr><th>Key</th><th>Last</th><th>History</th></tr>
+{{range .Charts}}{{$chart := .}}<tr>
+<td>{{.Name}}</td>
+<td class="value">{{range $i, $line := .Lines}}<div style="color: {{color $i}}">{{printf "%.4g" $line.Last}}{{if ne $line.Name $chart.Name}} <small>{{$line.Name}}</small>{{end}}</div>{{end}}</td>
+<td>{{sparkline .Lines}}</td>
+</tr>{{else}}<tr><td colspan="3">No metrics</td></tr>{{end}}
+</table>
+{{if .Graph}}<h2>Traces</h2>
+{{.Graph}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,83 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package trace
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
+)
+
+func TestDashboard(t *testing.T) {
+	clock := metric.NewFakeClock(time.Unix(1000, 0))
+	history := &metric.History{Clock: clock}
+
+	s := &metric.Summary{Step: time.Second}
+	for i := 0; i < 3; i++ {
+		s.Time = clock.Now().Add(time.Duration(i-3) * time.Second)
+		s.Count("Requests", i)
+		s.Record("Latency", i)
+		s.Write(history)
+		s.Reset()
+	}
+
+	g := &Graph{}
+	c := SetHandler(context.Background(), g)
+	c = Enter(c, "Begin")
+	foo(c, "Hello")
+	Leave(c, "End")
+
+	server := httptest.NewServer(&Dashboard{History: history, Graph: g})
+	defer server.Close()
+
+	get := func() string {
+		r, err := http.Get(server.URL + "?match=*")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer r.Body.Close()
+
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(data)
+	}
+
+	page := get()
+	for _, text := range []string{"<td>Requests</td>", "<td>Latency</td>", "<small>99th</small>", "<polyline", "Traces"} {
+		if !strings.Contains(page, text) {
+			t.Fatalf("expecting '%s' in the dashboard", text)
+		}
+	}
+
+	// the graph is only drawn again after the refresh period
+	c = Enter(SetHandler(context.Background(), g), "Begin")
+	Leave(Enter(c, "Later"), "End")
+	Leave(c, "End")
+
+	for i := 0; i < 100; i++ {
+		if dot, _ := g.DrawDOT(); strings.Contains(string(dot), "Later") {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if page := get(); strings.Contains(page, "Later") {
+		t.Fatalf("expecting the drawing of the graph to be kept")
+	}
+
+	clock.Advance(10 * time.Second)
+	if page := get(); !strings.Contains(page, "Later") {
+		t.Fatalf("expecting the graph to be drawn again")
+	}
+}
@@ -22,7 +22,8 @@ func New() Handler {
 	return &Periodic{
 		Period: *defaultPeriod,
 		Handler: &Metrics{
-			Prefix: "",
+			Prefix:    "",
+			Telemetry: true,
 			Reporter: metric.NewStack(
 				&metric.Carbon{
 					URLs:   strings.Split(*defaultCarbon, ","),
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"fmt"
 	"os/exec"
+	"sync"
 	"time"
 )
 
@@ -15,6 +16,7 @@ type Graph struct {
 	Nodes map[string]*Node
 
 	root Node
+	mu   sync.Mutex
 }
 
 // Node represents any node in the graph.
@@ -31,6 +33,9 @@ type Node struct {
 
 // HandleTrace updates the graph by keeping track of entering and leaving nodes.
 func (graph *Graph) HandleTrace(events []Event) {
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+
 	if graph.Nodes == nil {
 		graph.Nodes = make(map[string]*Node)
 	}
@@ -146,6 +151,9 @@ func (graph *Graph) DrawSVG() (result []byte, err error) {
 
 // DrawDOT exports the graph in DOT format.
 func (graph *Graph) DrawDOT() (result []byte, err error) {
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+
 	nodes := make(map[string]*Node)
 
 	// declare explore to traverse recursively
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
 )
 
 // Metrics creates metrics from the trace of events.
@@ -13,6 +14,11 @@ type Metrics struct {
 	Prefix string
 	metric.Summary
 	metric.Reporter
+	// Telemetry records the metrics of the library itself with every report under metric.TelemetryPrefix.
+	// It should only be enabled on a single handler since the telemetry counters are consumed by the report.
+	Telemetry bool
+	// Collectors record metrics from other sources e.g. expvar before every report.
+	Collectors []metric.Collector
 }
 
 // HandleTrace updates the summary of metrics from the captured trace.
@@ -58,13 +64,27 @@ func (h *Metrics) Report(dt time.Duration) {
 		return
 	}
 
+	if h.Telemetry {
+		metric.Self.Record(&h.Summary)
+	}
+
+	for _, c := range h.Collectors {
+		c.Collect(&h.Summary)
+	}
+
 	h.Summary.Name = h.Prefix
-	h.Summary.Time = time.Now().UTC()
+	h.Summary.Time = now(h.Summary.Clock).UTC()
 	h.Summary.Step = dt
 	h.Summary.Write(h.Reporter)
 	h.Summary.Reset()
 }
 
 func (h *Metrics) Close() {
-	h.Report(time.Since(h.Summary.Time))
+	h.Report(now(h.Summary.Clock).Sub(h.Summary.Time))
+}
+
+// Stop reports the current period and waits for the reporter to deliver the pending metrics.
+func (h *Metrics) Stop(c context.Context) error {
+	h.Close()
+	return metric.Stop(c, h.Reporter)
 }
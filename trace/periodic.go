@@ -4,53 +4,197 @@ package trace
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
 )
 
 // Periodic serializes access to the trace handler with a periodic report.
+// The depth of the queue is added to the telemetry as 'Periodic.Queue' on every report.
 type Periodic struct {
 	Handler
 	Period time.Duration
+	// Clock provides the ticker used to report periodically.
+	// Will use metric.DefaultClock if nil.
+	Clock metric.Clock
+	// Async returns from HandleTrace without waiting for the handler to process the events.
+	// Events are copied so that the timeline can be recycled right away.
+	// When the queue is full, traces are dropped instead of blocking the caller.
+	// The number of dropped traces is added to the telemetry as 'Periodic.Dropped'.
+	Async bool
+	// Backlog contains the number of traces and reports that can be queued. Will use 65536 if 0.
+	Backlog int
+	// Sample keeps only one out of Sample traces once the queue is half full in asynchronous mode.
+	// Sampling is disabled if 0.
+	Sample int
 
-	feed chan func()
-	once sync.Once
+	dropped int64
+	sampled int64
+	feed    chan func()
+	once    sync.Once
+	stop    sync.Once
+	mu      sync.RWMutex
+	stopped bool
+	quit    chan struct{}
+	done    chan struct{}
 }
 
 // HandleTrace pushes the processing of the trace of events on the same channel as the periodic callback.
 func (h *Periodic) HandleTrace(events []Event) {
 	h.once.Do(h.initialize)
 
+	if h.Async {
+		h.enqueue(events)
+		return
+	}
+
 	done := make(chan struct{})
-	h.feed <- func() {
+	ok := h.push(func() {
 		h.Handler.HandleTrace(events)
 		close(done)
+	}, true)
+
+	if ok {
+		<-done
 	}
+}
 
-	<-done
+// enqueue queues a copy of the events unless they are dropped by the sampling or because the queue is full.
+func (h *Periodic) enqueue(events []Event) {
+	if n := h.Sample; n > 1 && 2*len(h.feed) >= cap(h.feed) {
+		if atomic.AddInt64(&h.sampled, 1)%int64(n) != 0 {
+			atomic.AddInt64(&h.dropped, 1)
+			return
+		}
+	}
+
+	queue := make([]Event, len(events))
+	copy(queue, events)
+
+	ok := h.push(func() {
+		h.Handler.HandleTrace(queue)
+	}, false)
+
+	if !ok {
+		atomic.AddInt64(&h.dropped, 1)
+	}
 }
 
 func (h *Periodic) Report(dt time.Duration) {
 	h.once.Do(h.initialize)
 
-	h.feed <- func() {
+	h.push(func() {
+		metric.Self.Set("Periodic.Queue", float64(len(h.feed)))
+		if h.Async {
+			metric.Self.Count("Periodic.Dropped", float64(atomic.SwapInt64(&h.dropped, 0)))
+		}
+
 		h.Handler.Report(dt)
-	}
+	}, true)
 }
 
 func (h *Periodic) Close() {
 	h.once.Do(h.initialize)
 
-	h.feed <- func() {
+	h.push(func() {
 		h.Handler.Close()
+	}, true)
+}
+
+// Stop ends the periodic report and closes the handler which flushes the current period.
+// If the handler implements a Stop method, it is used instead of Close to also wait for its reporters.
+// Stop returns once the queued traces are processed or when the context is done.
+// Traces received afterwards are ignored and stopping again returns metric.ErrStopped.
+func (h *Periodic) Stop(c context.Context) (err error) {
+	h.once.Do(h.initialize)
+
+	first := false
+	h.stop.Do(func() {
+		// abort the pushes waiting for room in the queue so that the lock is released
+		close(h.quit)
+		first = true
+	})
+
+	if !first {
+		return metric.ErrStopped
+	}
+
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+
+	// nothing is pushed once stopped so the handler is closed last
+	result := make(chan error, 1)
+	go func() {
+		h.feed <- func() {
+			if s, ok := h.Handler.(interface {
+				Stop(context.Context) error
+			}); ok {
+				result <- s.Stop(c)
+			} else {
+				h.Handler.Close()
+				result <- nil
+			}
+		}
+
+		close(h.feed)
+	}()
+
+	select {
+	case <-h.done:
+		err = <-result
+	case <-c.Done():
+		err = c.Err()
+	}
+
+	return
+}
+
+// push queues the function unless the handler was stopped.
+// Without blocking, the function isn't queued when the queue is full.
+func (h *Periodic) push(f func(), block bool) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.stopped {
+		return false
+	}
+
+	if block {
+		select {
+		case h.feed <- f:
+			return true
+		case <-h.quit:
+			return false
+		}
+	}
+
+	select {
+	case h.feed <- f:
+		return true
+	default:
+		return false
 	}
 }
 
 func (h *Periodic) initialize() {
-	h.feed = make(chan func(), 65536)
+	h.quit = make(chan struct{})
+	h.done = make(chan struct{})
+
+	n := h.Backlog
+	if n == 0 {
+		n = 65536
+	}
+
+	h.feed = make(chan func(), n)
 	go func() {
 		for f := range h.feed {
 			f()
 		}
+
+		close(h.done)
 	}()
 
 	dt := h.Period
@@ -58,10 +202,17 @@ func (h *Periodic) initialize() {
 		dt = time.Second
 	}
 
-	ticker := time.Tick(dt)
+	ticker := orDefault(h.Clock).NewTicker(dt)
 	go func() {
-		for _ = range ticker {
-			h.Report(dt)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				h.Report(dt)
+			case <-h.quit:
+				return
+			}
 		}
 	}()
 }
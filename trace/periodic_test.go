@@ -0,0 +1,129 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datacratic/gometrics/metric"
+	"golang.org/x/net/context"
+)
+
+type reports chan time.Duration
+
+func (r reports) HandleTrace(events []Event) {
+}
+
+func (r reports) Report(dt time.Duration) {
+	r <- dt
+}
+
+func (r reports) Close() {
+}
+
+func TestPeriodic(t *testing.T) {
+	clock := metric.NewFakeClock(time.Unix(0, 0))
+
+	r := make(reports, 1)
+	h := &Periodic{
+		Handler: r,
+		Period:  time.Minute,
+		Clock:   clock,
+	}
+
+	h.HandleTrace(nil)
+	clock.Advance(time.Minute)
+
+	select {
+	case dt := <-r:
+		if dt != time.Minute {
+			t.Fatalf("expecting a report for %s instead of %s", time.Minute, dt)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("missing report")
+	}
+}
+
+type blocked chan struct{}
+
+func (b blocked) HandleTrace(events []Event) {
+	<-b
+}
+
+func (b blocked) Report(dt time.Duration) {
+}
+
+func (b blocked) Close() {
+}
+
+func TestPeriodicAsync(t *testing.T) {
+	b := make(blocked)
+	h := &Periodic{
+		Handler: b,
+		Period:  time.Minute,
+		Clock:   metric.NewFakeClock(time.Unix(0, 0)),
+		Async:   true,
+		Backlog: 1,
+	}
+
+	// the first trace is being handled, the second is queued and the others are dropped
+	for i := 0; i < 4; i++ {
+		h.HandleTrace([]Event{{}})
+		if i == 0 {
+			for len(h.feed) != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	close(b)
+
+	if h.dropped != 2 {
+		t.Fatalf("expecting 2 dropped traces instead of %d", h.dropped)
+	}
+}
+
+func TestPeriodicStop(t *testing.T) {
+	b := make(blocked)
+	defer close(b)
+
+	h := &Periodic{
+		Handler: b,
+		Period:  time.Minute,
+		Clock:   metric.NewFakeClock(time.Unix(0, 0)),
+		Async:   true,
+		Backlog: 1,
+	}
+
+	// the first trace is being handled and the second fills the queue
+	h.HandleTrace([]Event{{}})
+	for len(h.feed) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.HandleTrace([]Event{{}})
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := h.Stop(c); err != context.DeadlineExceeded {
+		t.Fatalf("expecting the stop to time out instead of %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.Report(time.Minute)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expecting reports to be ignored once stopped")
+	}
+
+	if err := h.Stop(context.Background()); err != metric.ErrStopped {
+		t.Fatalf("expecting a second stop to fail instead of %v", err)
+	}
+}